@@ -1,10 +1,13 @@
 package queue
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // AsyncQueue processes queue data asynchronously.
@@ -12,28 +15,184 @@ type AsyncQueue interface {
 	// Add data to the queue. Safe for concurrent use.
 	Enqueue(data []byte) error
 
+	// Limit how many items per second the workers dequeue in total,
+	// allowing bursts of up to burst items. A rate <= 0 removes the limit.
+	// Safe for concurrent use.
+	SetRate(rate float64, burst int)
+
+	// Set the number of workers. Removed workers finish the data they are
+	// handling. When autoscaling is enabled the number may later be changed
+	// within its bounds. Safe for concurrent use.
+	SetWorkers(n int) error
+
+	// Workers returns the current number of workers.
+	Workers() int
+
+	// Pause stops workers from dequeuing once they finish the data they are
+	// handling. Data can still be added while paused.
+	Pause() error
+
+	// Resume wakes paused workers.
+	Resume() error
+
+	// State returns the current state of the queue.
+	State() AsyncState
+
+	// Wait blocks until the inner queue is empty, no data is waiting to be
+	// retried and no handler is running, or until ctx is done. Data added
+	// other than through Enqueue may not be waited for.
+	Wait(ctx context.Context) error
+
+	// InFlight returns the number of handlers currently running.
+	InFlight() int
+
+	// Stats returns counts of how data has been handled.
+	Stats() AsyncStats
+
+	// Shutdown stops accepting data and waits until the workers have
+	// handled everything in the inner queue, including pending retries,
+	// then closes the queue like Close. If ctx is done first, workers are
+	// stopped early and the number of items left in the inner queue is
+	// returned with ctx's error, to which errors from closing the queue or
+	// reading its length are added. The number is -1 if the inner queue
+	// does not implement Lener or its length cannot be read. Handlers
+	// still running are not waited for: they finish in the background,
+	// and data for which they return an error is then added back to the
+	// inner queue, which should not be closed until they are done.
+	Shutdown(ctx context.Context) (int, error)
+
 	// Close the queue. Can be done at any point after the queue is
 	// constructed.
 	io.Closer
 }
 
+// AsyncState is the state of an async queue.
+type AsyncState int
+
+const (
+	// Workers are handling data.
+	AsyncRunning AsyncState = iota
+
+	// Workers are paused, data is still accepted.
+	AsyncPaused
+
+	// The queue is shutting down, handling remaining data.
+	AsyncDraining
+
+	// The queue is closed.
+	AsyncClosed
+)
+
+func (s AsyncState) String() string {
+	switch s {
+	case AsyncRunning:
+		return "running"
+	case AsyncPaused:
+		return "paused"
+	case AsyncDraining:
+		return "draining"
+	case AsyncClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// AsyncStats counts how data has been handled by an async queue.
+type AsyncStats struct {
+	// Handler returned successfully.
+	Succeeded uint64
+
+	// Handler returned an error or timed out.
+	Failed uint64
+
+	// Handler timed out, included in Failed.
+	TimedOut uint64
+
+	// Handler panicked.
+	Panicked uint64
+}
+
 // Handler operates on data from the async queue. Err comes from the inner
 // queue's dequeue operation when err is not ErrEmpty.
 type Handler func(data []byte, err error)
 
+// AsyncConfig is used to configure the behaviour of the async queue.
+type AsyncConfig struct {
+	// Number of workers processing data initially.
+	Workers int
+
+	// Maximum time a ContextHandler may take to handle data, after which
+	// its context is cancelled. Unless the handler then returns nil, the
+	// data is treated as failed once it returns. Zero means no limit.
+	Timeout time.Duration
+
+	// Scale the number of workers automatically. Nil disables autoscaling.
+	Scale *ScaleConfig
+
+	// Maximum number of items per second dequeued by all workers together.
+	// Zero means no limit.
+	Rate float64
+
+	// Number of items which may be dequeued at once when the workers have
+	// been below Rate for a while. Values below one are treated as one.
+	Burst int
+
+	// Retries of data for which a RetryHandler returns an error. When nil,
+	// DefaultRetryConfig is used. Ignored by queues with a plain Handler.
+	Retry *RetryConfig
+
+	// Receives errors from queues created by NewRetryQueue: errors from the
+	// inner queue's dequeue operation, and a *RetryError for data which is
+	// given up on. Errors are dropped if the channel is nil or full.
+	Errors chan<- error
+
+	// Polling of the inner queue for data added other than through the
+	// async queue. Nil disables polling.
+	Poll *PollConfig
+
+	// Stop dequeuing after repeated handler failures. Nil disables the
+	// circuit breaker.
+	Breaker *BreakerConfig
+
+	// Middleware wrapping the Handler given to NewAsyncQueueConfig, the
+	// first being called first. Constructors taking handlers which return
+	// errors fail when middleware is given, rather than ignore it.
+	Middleware []Middleware
+
+	// Dealing with handler panics. When nil, data whose handler panics is
+	// discarded.
+	Panic *PanicConfig
+}
+
 type async struct {
 	q       Queue
-	handler Handler
-	workers int
+	process processFunc
+	timeout time.Duration
+	ctx     context.Context // cancelled when workers are stopped
+	cancel  context.CancelFunc
+	report  func(err error)
+	retry   *RetryConfig
+	retries *retries
+	breaker *breaker
+	panic   *PanicConfig
+	limiter *limiter
+	stats   workerStats
+	idle    *idleState
 
-	state int32
-	wait  chan struct{}
-	done  chan struct{}
-	wg    sync.WaitGroup
+	mu     sync.Mutex
+	stops  []chan struct{} // one per worker, closed to stop it
+	resume chan struct{}   // non-nil while paused, closed to resume
+	state  int32
+	wait   chan struct{}
+	drain  chan struct{}
+	quit   chan struct{} // closed when the queue stops accepting data
+	wg     sync.WaitGroup
 }
 
 const (
 	open int32 = iota
+	draining
 	closed
 )
 
@@ -41,88 +200,523 @@ const (
 // a handler and worker pool. Closing the async queue does NOT close the inner
 // queue.
 func NewAsyncQueue(q Queue, handler Handler, workers int) (AsyncQueue, error) {
+	return NewAsyncQueueConfig(q, handler, &AsyncConfig{
+		Workers: workers,
+	})
+}
+
+// NewAsyncQueueConfig creates an async queue like NewAsyncQueue, configured by
+// cfg. When a nil config is given, reasonable defaults will be used.
+func NewAsyncQueueConfig(q Queue, handler Handler, cfg *AsyncConfig) (AsyncQueue, error) {
 	if q == nil {
 		return nil, errors.New("queue: async: queue is nil")
 	}
 	if handler == nil {
 		return nil, errors.New("queue: async: handler is nil")
 	}
-	if workers <= 0 {
+	if cfg != nil {
+		handler = Chain(handler, cfg.Middleware...)
+	}
+	process := func(ctx context.Context, closed <-chan struct{}, data []byte,
+		attempt int) error {
+		handler(data, nil)
+		return nil
+	}
+	report := func(err error) {
+		handler(nil, err)
+	}
+	return newAsync(q, process, report, nil, cfg)
+}
+
+// NewRetryQueue creates an async queue like NewAsyncQueueConfig, which retries
+// data for which handler returns an error. Retries wait in memory, and are
+// added back to the inner queue when the async queue is closed, losing their
+// attempt count. Data waiting to be retried is NOT in the inner queue, so it is
+// lost if the process exits without closing the async queue, even when the
+// inner queue is durable; with the default config data may wait up to
+// MaxBackoff between attempts. Set RetryConfig.Durable to keep data being
+// retried in the inner queue instead.
+func NewRetryQueue(q Queue, handler RetryHandler, cfg *AsyncConfig) (AsyncQueue, error) {
+	if q == nil {
+		return nil, errors.New("queue: async: queue is nil")
+	}
+	if handler == nil {
+		return nil, errors.New("queue: async: handler is nil")
+	}
+	process := func(ctx context.Context, closed <-chan struct{}, data []byte,
+		attempt int) error {
+		return handler(data, attempt)
+	}
+	return newRetryAsync(q, process, cfg)
+}
+
+// Create an async queue with retries, reporting errors to cfg.Errors.
+func newRetryAsync(q Queue, process processFunc, cfg *AsyncConfig) (AsyncQueue, error) {
+	retry := DefaultRetryConfig
+	var errs chan<- error
+	if cfg != nil {
+		if len(cfg.Middleware) > 0 {
+			return nil, errors.New("queue: async: middleware requires a Handler")
+		}
+		if cfg.Retry != nil {
+			retry = *cfg.Retry
+		}
+		errs = cfg.Errors
+	}
+	if retry.MaxAttempts <= 0 {
+		return nil, errors.New("queue: async: max attempts <= 0")
+	}
+	if retry.Jitter < 0 || retry.Jitter > 1 {
+		return nil, errors.New("queue: async: jitter not between 0 and 1")
+	}
+	report := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	return newAsync(q, process, report, &retry, cfg)
+}
+
+// Handle data, returning an error if it should be retried. Closed is closed when
+// the queue is closed, and handlers should no longer be waited for.
+type processFunc func(ctx context.Context, closed <-chan struct{}, data []byte,
+	attempt int) error
+
+func newAsync(q Queue, process processFunc, report func(error),
+	retry *RetryConfig, cfg *AsyncConfig) (AsyncQueue, error) {
+	if cfg == nil {
+		cfg = &AsyncConfig{
+			Workers: 5,
+		}
+	}
+	if cfg.Workers <= 0 {
 		return nil, errors.New("queue: async: workers <= 0")
 	}
+	if cfg.Timeout < 0 {
+		return nil, errors.New("queue: async: timeout < 0")
+	}
+	if cfg.Scale != nil {
+		if err := cfg.Scale.check(cfg.Workers); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Breaker != nil {
+		if err := cfg.Breaker.check(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Poll != nil {
+		if err := cfg.Poll.check(); err != nil {
+			return nil, err
+		}
+	}
+	var panicCfg *PanicConfig
+	if cfg.Panic != nil {
+		if err := cfg.Panic.check(); err != nil {
+			return nil, err
+		}
+		c := *cfg.Panic
+		panicCfg = &c
+	}
 	aq := &async{
 		q:       q,
-		handler: handler,
-		workers: workers,
+		process: process,
+		timeout: cfg.Timeout,
+		report:  report,
+		retry:   retry,
+		retries: newRetries(),
+		breaker: newBreaker(cfg.Breaker),
+		idle:    newIdleState(),
+		panic:   panicCfg,
+		limiter: newLimiter(cfg.Rate, cfg.Burst),
 		state:   open,
-		wait:    make(chan struct{}, workers),
-		done:    make(chan struct{}, workers),
+		wait:    make(chan struct{}, 1),
+		drain:   make(chan struct{}),
+		quit:    make(chan struct{}),
+	}
+	aq.ctx, aq.cancel = context.WithCancel(context.Background())
+	aq.resize(cfg.Workers)
+	if cfg.Scale != nil {
+		aq.wg.Add(1)
+		go aq.autoscale(*cfg.Scale)
 	}
-	aq.wg.Add(workers)
-	for i := 0; i < workers; i++ {
-		go aq.consume()
+	if cfg.Poll != nil {
+		aq.wg.Add(1)
+		go aq.poll(*cfg.Poll)
 	}
 	return aq, nil
 }
 
 func (q *async) Enqueue(data []byte) error {
-	if atomic.LoadInt32(&q.state) == closed {
+	if atomic.LoadInt32(&q.state) != open {
 		return errors.New("async: enqueue on closed queue")
 	}
 	err := q.q.Enqueue(data)
 	if err == nil {
+		q.idle.enqueue()
+		q.wake()
+	}
+	return err
+}
+
+// Wake a sleeping worker. One pending wake is enough however many workers
+// there are, since each worker dequeuing data wakes another.
+func (q *async) wake() {
+	select {
+	case q.wait <- struct{}{}:
+	default:
+	}
+}
+
+func (q *async) SetRate(rate float64, burst int) {
+	q.limiter.set(rate, burst)
+}
+
+func (q *async) SetWorkers(n int) error {
+	if n <= 0 {
+		return errors.New("async: workers <= 0")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if atomic.LoadInt32(&q.state) != open {
+		return errors.New("async: set workers on closed queue")
+	}
+	q.resize(n)
+	return nil
+}
+
+func (q *async) Workers() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.stops)
+}
+
+// Start or stop workers until there are n. Must be called with mu held, or
+// before the queue is shared.
+func (q *async) resize(n int) {
+	for len(q.stops) < n {
+		stop := make(chan struct{})
+		q.stops = append(q.stops, stop)
+		q.wg.Add(1)
+		go q.consume(stop)
+	}
+	for len(q.stops) > n {
+		close(q.stops[len(q.stops)-1])
+		q.stops = q.stops[:len(q.stops)-1]
+	}
+}
+
+func (q *async) Pause() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if atomic.LoadInt32(&q.state) != open {
+		return errors.New("async: pause on closed queue")
+	}
+	if q.resume == nil {
+		q.resume = make(chan struct{})
+	}
+	return nil
+}
+
+func (q *async) Resume() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if atomic.LoadInt32(&q.state) != open {
+		return errors.New("async: resume on closed queue")
+	}
+	q.unpause()
+	return nil
+}
+
+// Must be called with mu held.
+func (q *async) unpause() {
+	if q.resume != nil {
+		close(q.resume)
+		q.resume = nil
+	}
+}
+
+// Return a channel closed on resume, or nil if the queue is not paused.
+func (q *async) paused() chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.resume
+}
+
+func (q *async) State() AsyncState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch atomic.LoadInt32(&q.state) {
+	case draining:
+		return AsyncDraining
+	case closed:
+		return AsyncClosed
+	}
+	if q.resume != nil {
+		return AsyncPaused
+	}
+	return AsyncRunning
+}
+
+// Change state from open to next, stopping the autoscaler and resuming paused
+// workers so that they can drain or stop.
+func (q *async) transition(next int32) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !atomic.CompareAndSwapInt32(&q.state, open, next) {
+		return false
+	}
+	close(q.quit)
+	q.unpause()
+	return true
+}
+
+func (q *async) Wait(ctx context.Context) error {
+	for {
+		if atomic.LoadInt32(&q.state) == closed {
+			return errors.New("async: wait on closed queue")
+		}
+		idle, changed := q.idle.idle()
+		if idle && q.retries.empty() {
+			return nil
+		}
+		// Make sure a worker checks the inner queue.
+		q.wake()
 		select {
-		case q.wait <- struct{}{}:
-		default:
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
-	return err
+}
+
+func (q *async) InFlight() int {
+	return q.idle.inFlight()
+}
+
+func (q *async) Stats() AsyncStats {
+	return AsyncStats{
+		Succeeded: atomic.LoadUint64(&q.stats.succeeded),
+		Failed:    atomic.LoadUint64(&q.stats.failed),
+		TimedOut:  atomic.LoadUint64(&q.stats.timedOut),
+		Panicked:  atomic.LoadUint64(&q.stats.panicked),
+	}
+}
+
+func (q *async) Shutdown(ctx context.Context) (int, error) {
+	if !q.transition(draining) {
+		return 0, errors.New("async: shutdown on closed queue")
+	}
+	close(q.drain)
+	finished := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		atomic.StoreInt32(&q.state, closed)
+		return 0, q.stop()
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	q.resize(0)
+	q.mu.Unlock()
+	// Handlers still running finish in the background. Since the queue's
+	// context is cancelled, their data is added back to the inner queue
+	// if they fail, rather than retried.
+	q.cancel()
+	atomic.StoreInt32(&q.state, closed)
+	// Keep ctx's error so that callers can tell the deadline passed.
+	err := ctx.Err()
+	if err2 := q.stop(); err2 != nil {
+		err = fmt.Errorf("%w; %v", err, err2)
+	}
+	n := -1
+	if l, ok := q.q.(Lener); ok {
+		if left, err2 := l.Len(); err2 != nil {
+			err = fmt.Errorf("%w; %v", err, err2)
+		} else {
+			n = left
+		}
+	}
+	return n, err
 }
 
 func (q *async) Close() error {
-	if atomic.LoadInt32(&q.state) == closed {
+	if !q.transition(closed) {
 		return errors.New("async: close on closed queue")
 	}
-	for i := 0; i < q.workers; i++ {
-		q.done <- struct{}{}
-	}
+	q.mu.Lock()
+	q.resize(0)
+	q.mu.Unlock()
+	q.cancel()
 	q.wg.Wait()
-	atomic.StoreInt32(&q.state, closed)
-	close(q.done)
-	close(q.wait)
-	return nil
+	return q.stop()
 }
 
-func (q *async) consume() {
+// Return pending retries to the inner queue once the workers have stopped.
+func (q *async) stop() error {
+	q.cancel()
+	var err error
+	for _, it := range q.retries.drain() {
+		if err2 := q.q.Enqueue(it.data); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+func (q *async) consume(stop chan struct{}) {
 	defer q.wg.Done()
 	wait := false
 	for {
 		if wait {
+			drain := q.drain
+			if atomic.LoadInt32(&q.state) == draining {
+				if q.retries.empty() {
+					return
+				}
+				drain = nil
+			}
+			// Sleep until data is added or a retry is due.
+			var due <-chan time.Time
+			timer := q.retries.timer()
+			if timer != nil {
+				due = timer.C
+			}
 			select {
 			case <-q.wait:
-			case <-q.done:
+			case <-due:
+			case <-drain:
+			case <-stop:
 				return
 			}
+			if timer != nil {
+				timer.Stop()
+			}
 		} else {
 			select {
-			case <-q.done:
+			case <-stop:
 				return
 			default:
 			}
 		}
+		if resume := q.paused(); resume != nil {
+			select {
+			case <-resume:
+			case <-stop:
+				return
+			}
+		}
+		probe, ok := q.breaker.allow(stop)
+		if !ok {
+			return
+		}
+		if !q.limiter.wait(stop) {
+			q.breaker.release(probe)
+			return
+		}
+		if q.paused() != nil {
+			// Paused while waiting for the breaker or limiter.
+			q.limiter.refund()
+			q.breaker.release(probe)
+			wait = false
+			continue
+		}
 		wait = q.handle()
+		if wait {
+			// Nothing was dequeued.
+			q.limiter.refund()
+		}
+		q.breaker.release(probe)
 	}
 }
 
-func (q *async) handle() bool {
+func (q *async) handle() (empty bool) {
+	var it *item
+	gen := q.idle.begin()
+	defer func() {
+		q.idle.end(gen, empty, it != nil)
+	}()
 	defer func() {
 		// Continue normal execution even if handler panics.
-		_ = recover()
+		if v := recover(); v != nil {
+			q.panicked(v, it)
+		}
 	}()
-	data, err := q.q.Dequeue()
-	if err == ErrEmpty {
-		return true
+	it = q.retries.pop()
+	if it != nil {
+		q.idle.handle()
+	} else {
+		data, err := q.q.Dequeue()
+		if err == ErrEmpty {
+			q.stats.setEmpty(true)
+			return true
+		}
+		if err != nil {
+			q.report(err)
+			return false
+		}
+		q.stats.setEmpty(false)
+		atomic.AddUint64(&q.stats.dequeued, 1)
+		it = &item{data: data}
+		if q.retry != nil && q.retry.Durable {
+			it.data, it.attempt = decodeRetry(data)
+		}
+		q.idle.handle()
+		// Wake another worker in case there is more data.
+		q.wake()
+	}
+	it.attempt++
+	ctx, cancel := q.ctx, context.CancelFunc(nil)
+	if q.timeout > 0 {
+		ctx, cancel = context.WithTimeout(q.ctx, q.timeout)
+	}
+	start := time.Now()
+	err := q.process(ctx, q.ctx.Done(), it.data, it.attempt)
+	q.stats.handled(time.Since(start))
+	if cancel != nil {
+		cancel()
+	}
+	switch {
+	case err == nil:
+		atomic.AddUint64(&q.stats.succeeded, 1)
+		q.breaker.record(true)
+	case q.ctx.Err() != nil:
+		// The queue was closed while handling the data, which is
+		// kept for later.
+		data := it.data
+		if q.retry != nil && q.retry.Durable && it.attempt > 1 {
+			data = encodeRetry(it.data, it.attempt-1)
+		}
+		if err = q.q.Enqueue(data); err != nil {
+			q.report(err)
+		}
+	default:
+		atomic.AddUint64(&q.stats.failed, 1)
+		q.breaker.record(false)
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddUint64(&q.stats.timedOut, 1)
+		}
+		if q.retry == nil || it.attempt >= q.retry.MaxAttempts {
+			q.report(&RetryError{
+				Data:     it.data,
+				Attempts: it.attempt,
+				Err:      err,
+			})
+		} else if q.retry.Durable {
+			if err = q.q.Enqueue(encodeRetry(it.data,
+				it.attempt)); err != nil {
+				q.report(err)
+			}
+		} else if !q.retries.push(it, q.retry) {
+			// The queue was stopped while handling the data.
+			if err = q.q.Enqueue(it.data); err != nil {
+				q.report(err)
+			}
+		}
 	}
-	q.handler(data, err)
 	return false
 }
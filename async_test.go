@@ -1,12 +1,16 @@
 package queue_test
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/esote/queue"
+	"github.com/esote/queue/internal/tmpdb"
 )
 
 func TestAsyncSimple(t *testing.T) {
@@ -27,8 +31,9 @@ func TestAsyncSimple(t *testing.T) {
 			t.Fatal(err)
 		}
 	}
-	// Wait for v to become 0.
-	time.Sleep(10 * time.Millisecond)
+	if err = q.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
 	if atomic.LoadUint32(&v) != 0 {
 		t.Fatal("async: v != 0")
 	}
@@ -118,3 +123,957 @@ func TestAsyncRace(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestAsyncRate(t *testing.T) {
+	const n = 10
+	done := make(chan struct{}, n)
+	handler := func(data []byte, err error) {
+		done <- struct{}{}
+	}
+	cfg := &queue.AsyncConfig{
+		Workers: 3,
+		Rate:    100,
+		Burst:   1,
+	}
+	q, err := queue.NewAsyncQueueConfig(queue.NewMemoryQueue(), handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err = q.Enqueue(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		<-done
+	}
+	// The first item is taken from the full bucket.
+	if elapsed := time.Since(start); elapsed < (n-1)*10*time.Millisecond {
+		t.Fatalf("%d items handled in %s", n, elapsed)
+	}
+}
+
+func TestAsyncSetRate(t *testing.T) {
+	const n = 5
+	done := make(chan struct{}, n)
+	handler := func(data []byte, err error) {
+		done <- struct{}{}
+	}
+	cfg := &queue.AsyncConfig{
+		Workers: 2,
+		Rate:    0.1,
+	}
+	q, err := queue.NewAsyncQueueConfig(queue.NewMemoryQueue(), handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < n; i++ {
+		if err = q.Enqueue(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	timer := time.NewTimer(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("rate exceeded")
+	case <-timer.C:
+	}
+	// Remove limit while workers are waiting for tokens.
+	q.SetRate(0, 0)
+	timer = time.NewTimer(time.Second)
+	defer timer.Stop()
+	for i := 1; i < n; i++ {
+		select {
+		case <-done:
+		case <-timer.C:
+			t.Fatal("rate limit not removed")
+		}
+	}
+}
+
+func TestAsyncRetry(t *testing.T) {
+	attempts := make(chan int, 10)
+	handler := func(data []byte, attempt int) error {
+		attempts <- attempt
+		if attempt < 3 {
+			return errors.New("fail")
+		}
+		return nil
+	}
+	cfg := &queue.AsyncConfig{
+		Workers: 2,
+		Retry: &queue.RetryConfig{
+			MaxAttempts: 5,
+			Backoff:     10 * time.Millisecond,
+		},
+	}
+	q, err := queue.NewRetryQueue(queue.NewMemoryQueue(), handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	start := time.Now()
+	if err = q.Enqueue([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	for want := 1; want <= 3; want++ {
+		if have := <-attempts; have != want {
+			t.Fatalf("want attempt %d, have %d", want, have)
+		}
+	}
+	// Backoff doubles: 10ms then 20ms.
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("retried after %s", elapsed)
+	}
+	timer := time.NewTimer(50 * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case attempt := <-attempts:
+		t.Fatalf("unexpected attempt %d", attempt)
+	case <-timer.C:
+	}
+}
+
+func TestAsyncRetryGiveUp(t *testing.T) {
+	fail := errors.New("fail")
+	handler := func(data []byte, attempt int) error {
+		return fail
+	}
+	errs := make(chan error, 1)
+	cfg := &queue.AsyncConfig{
+		Workers: 1,
+		Retry: &queue.RetryConfig{
+			MaxAttempts: 3,
+			Backoff:     time.Millisecond,
+			Jitter:      0.5,
+		},
+		Errors: errs,
+	}
+	q, err := queue.NewRetryQueue(queue.NewMemoryQueue(), handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.Enqueue([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	select {
+	case err = <-errs:
+	case <-timer.C:
+		t.Fatal("data not given up on")
+	}
+	var rerr *queue.RetryError
+	if !errors.As(err, &rerr) || !errors.Is(err, fail) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if rerr.Attempts != 3 || string(rerr.Data) != "a" {
+		t.Fatalf("unexpected error %+v", rerr)
+	}
+}
+
+// Pending retries are returned to the inner queue on close.
+func TestAsyncRetryClose(t *testing.T) {
+	handled := make(chan struct{}, 1)
+	handler := func(data []byte, attempt int) error {
+		handled <- struct{}{}
+		return errors.New("fail")
+	}
+	cfg := &queue.AsyncConfig{
+		Workers: 1,
+		Retry: &queue.RetryConfig{
+			MaxAttempts: 2,
+			Backoff:     time.Hour,
+		},
+	}
+	inner := queue.NewMemoryQueue()
+	q, err := queue.NewRetryQueue(inner, handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Enqueue([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	<-handled
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := inner.Dequeue()
+	if err != nil || string(data) != "a" {
+		t.Fatalf("retry not returned to queue: %q (%v)", data, err)
+	}
+}
+
+// Durable retries are kept in the inner queue with their attempt count.
+func TestAsyncRetryDurable(t *testing.T) {
+	cfg := &queue.AsyncConfig{
+		Workers: 1,
+		Retry: &queue.RetryConfig{
+			MaxAttempts: 3,
+			Backoff:     time.Hour,
+			Durable:     true,
+		},
+	}
+	inner := queue.NewMemoryQueue()
+	var q queue.AsyncQueue
+	failed := make(chan struct{})
+	handler := func(data []byte, attempt int) error {
+		// Stop before the retry, as if the process crashed.
+		_ = q.Pause()
+		close(failed)
+		return errors.New("fail")
+	}
+	q, err := queue.NewRetryQueue(inner, handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.Enqueue([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	<-failed
+	for i := 0; ; i++ {
+		if n, _ := inner.(queue.Lener).Len(); n == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("retry not in inner queue")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	type call struct {
+		data    string
+		attempt int
+	}
+	calls := make(chan call, 1)
+	handler = func(data []byte, attempt int) error {
+		calls <- call{string(data), attempt}
+		return nil
+	}
+	q2, err := queue.NewRetryQueue(inner, handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q2.Close()
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	select {
+	case have := <-calls:
+		if want := (call{"a", 2}); have != want {
+			t.Fatalf("want %+v, have %+v", want, have)
+		}
+	case <-timer.C:
+		t.Fatal("retry lost")
+	}
+}
+
+func TestAsyncShutdown(t *testing.T) {
+	const n = 10
+	var handled uint32
+	handler := func(data []byte, err error) {
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddUint32(&handled, 1)
+	}
+	q, err := queue.NewAsyncQueue(queue.NewMemoryQueue(), handler, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err = q.Enqueue(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	left, err := q.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 || atomic.LoadUint32(&handled) != n {
+		t.Fatalf("%d left, %d handled", left, handled)
+	}
+	if err = q.Enqueue(nil); err == nil {
+		t.Fatal("enqueue after shutdown")
+	}
+	if err = q.Close(); err == nil {
+		t.Fatal("close after shutdown")
+	}
+}
+
+func TestAsyncShutdownTimeout(t *testing.T) {
+	const n = 10
+	handler := func(data []byte, err error) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	q, err := queue.NewAsyncQueue(queue.NewMemoryQueue(), handler, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err = q.Enqueue(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		20*time.Millisecond)
+	defer cancel()
+	left, err := q.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// The item being handled when the deadline passed is finished.
+	if left != n-1 {
+		t.Fatalf("%d left", left)
+	}
+}
+
+// Shutdown returns at the deadline, leaving hung handlers running.
+func TestAsyncShutdownHung(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	started := make(chan struct{}, 1)
+	handler := func(data []byte, attempt int) error {
+		started <- struct{}{}
+		<-hang
+		return errors.New("fail")
+	}
+	inner := queue.NewMemoryQueue()
+	q, err := queue.NewRetryQueue(inner, handler, &queue.AsyncConfig{
+		Workers: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Enqueue([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(),
+		20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	left, err := q.Shutdown(ctx)
+	if err != context.DeadlineExceeded || left != 0 {
+		t.Fatalf("%d left (%v)", left, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("shutdown took %s", d)
+	}
+	// The failed data is kept once the handler returns.
+	hang <- struct{}{}
+	for i := 0; ; i++ {
+		n, _ := inner.(queue.Lener).Len()
+		if n == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("data not kept")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Queue whose length cannot be read.
+type badLen struct {
+	queue.Queue
+}
+
+func (badLen) Len() (int, error) {
+	return 0, errors.New("no length")
+}
+
+// The deadline is reported even when the length cannot be read.
+func TestAsyncShutdownLenError(t *testing.T) {
+	handler := func(data []byte, err error) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	q, err := queue.NewAsyncQueue(badLen{queue.NewMemoryQueue()}, handler,
+		1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = q.Enqueue(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		20*time.Millisecond)
+	defer cancel()
+	left, err := q.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) ||
+		!strings.Contains(err.Error(), "no length") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if left != -1 {
+		t.Fatalf("%d left", left)
+	}
+}
+
+func TestAsyncSetWorkers(t *testing.T) {
+	const n = 3
+	started := make(chan struct{}, n)
+	release := make(chan struct{})
+	handler := func(data []byte, err error) {
+		started <- struct{}{}
+		<-release
+	}
+	q, err := queue.NewAsyncQueue(queue.NewMemoryQueue(), handler, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.SetWorkers(n); err != nil {
+		t.Fatal(err)
+	}
+	if q.Workers() != n {
+		t.Fatalf("have %d workers", q.Workers())
+	}
+	for i := 0; i < n; i++ {
+		if err = q.Enqueue(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for i := 0; i < n; i++ {
+		select {
+		case <-started:
+		case <-timer.C:
+			t.Fatalf("%d items handled concurrently", i)
+		}
+	}
+	if err = q.SetWorkers(1); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if q.Workers() != 1 {
+		t.Fatalf("have %d workers", q.Workers())
+	}
+	if err = q.SetWorkers(0); err == nil {
+		t.Fatal("zero workers allowed")
+	}
+}
+
+func TestAsyncAutoscale(t *testing.T) {
+	handler := func(data []byte, err error) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cfg := &queue.AsyncConfig{
+		Workers: 1,
+		Scale: &queue.ScaleConfig{
+			MinWorkers: 1,
+			MaxWorkers: 8,
+			Interval:   20 * time.Millisecond,
+		},
+	}
+	q, err := queue.NewAsyncQueueConfig(queue.NewMemoryQueue(), handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < 200; i++ {
+		if err = q.Enqueue(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitWorkers := func(ok func(int) bool) int {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if n := q.Workers(); ok(n) {
+				return n
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("have %d workers", q.Workers())
+		return 0
+	}
+	// Grows with the backlog, then shrinks back once idle.
+	waitWorkers(func(n int) bool { return n > 1 })
+	waitWorkers(func(n int) bool { return n == 1 })
+
+	cfg.Workers = 10
+	if _, err = queue.NewAsyncQueueConfig(queue.NewMemoryQueue(), handler,
+		cfg); err == nil {
+		t.Fatal("workers above maximum allowed")
+	}
+}
+
+func TestAsyncPause(t *testing.T) {
+	const n = 5
+	done := make(chan struct{}, n)
+	handler := func(data []byte, err error) {
+		done <- struct{}{}
+	}
+	q, err := queue.NewAsyncQueue(queue.NewMemoryQueue(), handler, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if q.State() != queue.AsyncPaused {
+		t.Fatalf("state %s", q.State())
+	}
+	for i := 0; i < n; i++ {
+		if err = q.Enqueue(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timer := time.NewTimer(30 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("data handled while paused")
+	case <-timer.C:
+	}
+	if err = q.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if q.State() != queue.AsyncRunning {
+		t.Fatalf("state %s", q.State())
+	}
+	timer = time.NewTimer(time.Second)
+	defer timer.Stop()
+	for i := 0; i < n; i++ {
+		select {
+		case <-done:
+		case <-timer.C:
+			t.Fatal("data not handled after resume")
+		}
+	}
+}
+
+// Paused queues can be closed or shut down.
+func TestAsyncPauseClose(t *testing.T) {
+	handler := func(data []byte, err error) {}
+	q, err := queue.NewAsyncQueue(queue.NewMemoryQueue(), handler, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if q.State() != queue.AsyncClosed {
+		t.Fatalf("state %s", q.State())
+	}
+	if err = q.Resume(); err == nil {
+		t.Fatal("resume after close")
+	}
+
+	q, err = queue.NewAsyncQueue(queue.NewMemoryQueue(), handler, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Enqueue(nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if left, err := q.Shutdown(ctx); err != nil || left != 0 {
+		t.Fatalf("%d left (%v)", left, err)
+	}
+}
+
+func TestAsyncPanicConfig(t *testing.T) {
+	type report struct {
+		v     interface{}
+		stack []byte
+		data  []byte
+	}
+	reports := make(chan report, 1)
+	var calls uint32
+	handler := func(data []byte, err error) {
+		if atomic.AddUint32(&calls, 1) == 1 {
+			panic("boom")
+		}
+	}
+	dead := queue.NewMemoryQueue()
+	for _, action := range []queue.PanicAction{queue.PanicRequeue,
+		queue.PanicDeadLetter} {
+		atomic.StoreUint32(&calls, 0)
+		cfg := &queue.AsyncConfig{
+			Workers: 1,
+			Panic: &queue.PanicConfig{
+				Handler: func(v interface{}, stack, data []byte) {
+					reports <- report{v, stack, data}
+				},
+				Action:     action,
+				DeadLetter: dead,
+			},
+		}
+		q, err := queue.NewAsyncQueueConfig(queue.NewMemoryQueue(),
+			handler, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Enqueue([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		r := <-reports
+		if r.v != "boom" || string(r.data) != "a" ||
+			!strings.Contains(string(r.stack), "panic") {
+			t.Fatalf("unexpected report %v %q", r.v, r.data)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Second)
+		_, err = q.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Requeued data is handled again.
+		if want := map[queue.PanicAction]uint32{
+			queue.PanicRequeue:    2,
+			queue.PanicDeadLetter: 1,
+		}[action]; atomic.LoadUint32(&calls) != want {
+			t.Fatalf("action %d: handled %d times", action, calls)
+		}
+	}
+	data, err := dead.Dequeue()
+	if err != nil || string(data) != "a" {
+		t.Fatalf("not dead lettered: %q (%v)", data, err)
+	}
+	cfg := &queue.AsyncConfig{
+		Workers: 1,
+		Panic: &queue.PanicConfig{
+			Action: queue.PanicDeadLetter,
+		},
+	}
+	if _, err = queue.NewAsyncQueueConfig(queue.NewMemoryQueue(), handler,
+		cfg); err == nil {
+		t.Fatal("nil dead letter queue allowed")
+	}
+}
+
+// Data added directly to the inner queue is picked up by polling.
+func TestAsyncPoll(t *testing.T) {
+	file, err := tmpdb.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := queue.NewSqlite3Queue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	inners := map[string]func() (queue.Queue, error){
+		"memory": func() (queue.Queue, error) {
+			return queue.NewMemoryQueue(), nil
+		},
+		"sqlite3": func() (queue.Queue, error) {
+			return queue.NewSqlite3Queue(file)
+		},
+	}
+	for name, open := range inners {
+		inner, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{}, 1)
+		handler := func(data []byte, err error) {
+			done <- struct{}{}
+		}
+		cfg := &queue.AsyncConfig{
+			Workers: 2,
+			Poll: &queue.PollConfig{
+				Interval:    5 * time.Millisecond,
+				MaxInterval: 20 * time.Millisecond,
+			},
+		}
+		q, err := queue.NewAsyncQueueConfig(inner, handler, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Let the poll interval back off.
+		time.Sleep(50 * time.Millisecond)
+		producer := inner
+		if name == "sqlite3" {
+			producer = other
+		}
+		if err = producer.Enqueue(nil); err != nil {
+			t.Fatal(err)
+		}
+		timer := time.NewTimer(time.Second)
+		select {
+		case <-done:
+			timer.Stop()
+		case <-timer.C:
+			t.Fatalf("%s: data not polled", name)
+		}
+		if err = q.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err = inner.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAsyncWait(t *testing.T) {
+	const n = 20
+	var handled uint32
+	release := make(chan struct{})
+	handler := func(data []byte, attempt int) error {
+		<-release
+		atomic.AddUint32(&handled, 1)
+		if data[0]%4 == 0 && attempt == 1 {
+			return errors.New("retry")
+		}
+		return nil
+	}
+	cfg := &queue.AsyncConfig{
+		Workers: 3,
+		Retry: &queue.RetryConfig{
+			MaxAttempts: 2,
+			Backoff:     10 * time.Millisecond,
+		},
+	}
+	q, err := queue.NewRetryQueue(queue.NewMemoryQueue(), handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < n; i++ {
+		if err = q.Enqueue([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		20*time.Millisecond)
+	defer cancel()
+	if err = q.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if have := q.InFlight(); have != 3 {
+		t.Fatalf("%d in flight", have)
+	}
+	close(release)
+	if err = q.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Every fourth item fails once and is retried.
+	if have := atomic.LoadUint32(&handled); have != n+n/4 {
+		t.Fatalf("handled %d times", have)
+	}
+	if have := q.InFlight(); have != 0 {
+		t.Fatalf("%d in flight", have)
+	}
+}
+
+// Data is not retried until the call which timed out returns.
+func TestAsyncContextTimeout(t *testing.T) {
+	var running, overlaps int32
+	done := make(chan struct{}, 1)
+	handler := func(ctx context.Context, data []byte, attempt int) error {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		defer atomic.AddInt32(&running, -1)
+		if attempt == 1 {
+			// Ignore the context for a while.
+			<-ctx.Done()
+			time.Sleep(30 * time.Millisecond)
+			return ctx.Err()
+		}
+		done <- struct{}{}
+		return nil
+	}
+	cfg := &queue.AsyncConfig{
+		Workers: 1,
+		Timeout: 10 * time.Millisecond,
+		Retry: &queue.RetryConfig{
+			MaxAttempts: 2,
+			Backoff:     time.Millisecond,
+		},
+	}
+	q, err := queue.NewContextQueue(queue.NewMemoryQueue(), handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.Enqueue(nil); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if err = q.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := queue.AsyncStats{
+		Succeeded: 1,
+		Failed:    1,
+		TimedOut:  1,
+	}
+	if have := q.Stats(); have != want {
+		t.Fatalf("want %+v, have %+v", want, have)
+	}
+	if n := atomic.LoadInt32(&overlaps); n != 0 {
+		t.Fatalf("%d calls overlapped", n)
+	}
+}
+
+// Closing does not wait for hung handlers, and keeps their data.
+func TestAsyncContextClose(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	started := make(chan context.Context, 1)
+	handler := func(ctx context.Context, data []byte, attempt int) error {
+		started <- ctx
+		<-hang
+		return nil
+	}
+	inner := queue.NewMemoryQueue()
+	q, err := queue.NewContextQueue(inner, handler, &queue.AsyncConfig{
+		Workers: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Enqueue([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	ctx := <-started
+	closed := make(chan error, 1)
+	go func() {
+		closed <- q.Close()
+	}()
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-timer.C:
+		t.Fatal("close blocked by handler")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Fatal("context not cancelled")
+	}
+	data, err := inner.Dequeue()
+	if err != nil || string(data) != "a" {
+		t.Fatalf("data not kept: %q (%v)", data, err)
+	}
+}
+
+func TestAsyncBreaker(t *testing.T) {
+	const (
+		n        = 10
+		cooldown = 30 * time.Millisecond
+	)
+	var calls uint32
+	handler := func(data []byte, attempt int) error {
+		// Three failures open the breaker, then the first probe fails.
+		if atomic.AddUint32(&calls, 1) <= 4 {
+			return errors.New("down")
+		}
+		return nil
+	}
+	var mu sync.Mutex
+	var changes []string
+	cfg := &queue.AsyncConfig{
+		Workers: 2,
+		Retry: &queue.RetryConfig{
+			MaxAttempts: 1,
+		},
+		Breaker: &queue.BreakerConfig{
+			Failures: 3,
+			Cooldown: cooldown,
+			OnStateChange: func(from, to queue.BreakerState) {
+				mu.Lock()
+				changes = append(changes, from.String()+">"+to.String())
+				mu.Unlock()
+			},
+		},
+	}
+	q, err := queue.NewRetryQueue(queue.NewMemoryQueue(), handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	// Fill the queue before the workers can handle any of it.
+	if err = q.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err = q.Enqueue(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	if err = q.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*cooldown {
+		t.Fatalf("breaker open for %s", elapsed)
+	}
+	stats := q.Stats()
+	if stats.Failed != 4 || stats.Succeeded != n-4 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := "closed>open,open>half-open,half-open>open," +
+		"open>half-open,half-open>closed"
+	if have := strings.Join(changes, ","); have != want {
+		t.Fatalf("want changes %s, have %s", want, have)
+	}
+}
+
+// Workers waiting for the rate limiter when paused do not handle data.
+func TestAsyncPauseRate(t *testing.T) {
+	const n = 5
+	done := make(chan struct{}, n)
+	handler := func(data []byte, err error) {
+		done <- struct{}{}
+	}
+	cfg := &queue.AsyncConfig{
+		Workers: 2,
+		Rate:    10,
+		Burst:   1,
+	}
+	q, err := queue.NewAsyncQueueConfig(queue.NewMemoryQueue(), handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < n; i++ {
+		if err = q.Enqueue(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first item uses the burst, the other worker waits for a token.
+	<-done
+	if err = q.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	timer := time.NewTimer(300 * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-done:
+		t.Fatal("data handled while paused")
+	case <-timer.C:
+	}
+	if err = q.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < n; i++ {
+		<-done
+	}
+}
@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("queue")
+
+type boltQueue struct {
+	db *bolt.DB
+}
+
+// NewBoltQueue creates a queue with ACID properties backed by a bbolt
+// key-value store, an alternative to the SQLite3 queue which does not require
+// cgo. Fails if another process has the file open.
+func NewBoltQueue(file string) (Queue, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &boltQueue{db: db}, nil
+}
+
+func (q *boltQueue) Enqueue(data []byte) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		// Keys are big-endian so that the cursor visits them in
+		// insertion order.
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], seq)
+		return b.Put(key[:], data)
+	})
+}
+
+func (q *boltQueue) Dequeue() ([]byte, error) {
+	var data []byte
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		key, value := c.First()
+		if key == nil {
+			return ErrEmpty
+		}
+		// Value is only valid during the transaction.
+		data = append([]byte(nil), value...)
+		return c.Delete()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (q *boltQueue) Len() (int, error) {
+	var n int
+	err := q.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(boltBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+func (q *boltQueue) Close() error {
+	return q.db.Close()
+}
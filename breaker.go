@@ -0,0 +1,182 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of an async queue's circuit breaker.
+type BreakerState int
+
+const (
+	// Data is dequeued as usual.
+	BreakerClosed BreakerState = iota
+
+	// No data is dequeued until the cool-down has passed.
+	BreakerOpen
+
+	// One item is dequeued as a probe, whose success closes the breaker and
+	// whose failure opens it again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerConfig is used to configure a circuit breaker, which stops workers
+// from dequeuing after repeated handler failures. Failures are errors returned
+// by RetryHandler or ContextHandler, including timeouts, and panics.
+type BreakerConfig struct {
+	// Number of consecutive failures which open the breaker.
+	Failures int
+
+	// How long the breaker stays open before a probe is allowed.
+	Cooldown time.Duration
+
+	// Called on each change of state, if not nil. Calls are made in order
+	// and must not block.
+	OnStateChange func(from, to BreakerState)
+}
+
+func (cfg *BreakerConfig) check() error {
+	if cfg.Failures <= 0 {
+		return errors.New("queue: async: breaker failures <= 0")
+	}
+	if cfg.Cooldown <= 0 {
+		return errors.New("queue: async: breaker cooldown <= 0")
+	}
+	return nil
+}
+
+type breaker struct {
+	cfg BreakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	until    time.Time // when the cool-down ends
+	probing  bool
+	changed  chan struct{}
+}
+
+func newBreaker(cfg *BreakerConfig) *breaker {
+	if cfg == nil {
+		return nil
+	}
+	return &breaker{
+		cfg:     *cfg,
+		changed: make(chan struct{}),
+	}
+}
+
+// Change state and wake waiting workers. Must be called with mu held.
+func (b *breaker) set(state BreakerState) {
+	from := b.state
+	b.state = state
+	b.failures = 0
+	b.probing = false
+	if state == BreakerOpen {
+		b.until = time.Now().Add(b.cfg.Cooldown)
+	}
+	b.broadcast()
+	if b.cfg.OnStateChange != nil {
+		b.cfg.OnStateChange(from, state)
+	}
+}
+
+// Must be called with mu held.
+func (b *breaker) broadcast() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Wait until a worker may dequeue, reporting whether it dequeues a probe.
+// Returns false if stop is closed first.
+func (b *breaker) allow(stop <-chan struct{}) (probe, ok bool) {
+	if b == nil {
+		return false, true
+	}
+	for {
+		b.mu.Lock()
+		if b.state == BreakerOpen && !time.Now().Before(b.until) {
+			b.set(BreakerHalfOpen)
+		}
+		switch {
+		case b.state == BreakerClosed:
+			b.mu.Unlock()
+			return false, true
+		case b.state == BreakerHalfOpen && !b.probing:
+			b.probing = true
+			b.mu.Unlock()
+			return true, true
+		}
+		changed := b.changed
+		var timer *time.Timer
+		var due <-chan time.Time
+		if b.state == BreakerOpen {
+			timer = time.NewTimer(time.Until(b.until))
+			due = timer.C
+		}
+		b.mu.Unlock()
+		stopped := false
+		select {
+		case <-changed:
+		case <-due:
+		case <-stop:
+			stopped = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopped {
+			return false, false
+		}
+	}
+}
+
+// Release a probe which did not handle data, so that another may be taken.
+func (b *breaker) release(probe bool) {
+	if b == nil || !probe {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen && b.probing {
+		b.probing = false
+		b.broadcast()
+	}
+}
+
+// Record the outcome of handling data.
+func (b *breaker) record(success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == BreakerOpen:
+		// Handled before the breaker opened.
+	case success && b.state == BreakerHalfOpen:
+		b.set(BreakerClosed)
+	case success:
+		b.failures = 0
+	case b.state == BreakerHalfOpen:
+		b.set(BreakerOpen)
+	default:
+		if b.failures++; b.failures >= b.cfg.Failures {
+			b.set(BreakerOpen)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Command queuectl inspects and modifies SQLite3 queue files created by
+// queue.NewSqlite3Queue.
+//
+// Usage:
+//
+//	queuectl [flags] command file [n]
+//
+// The commands are:
+//
+//	stats    print the number of entries, their id range and the file size
+//	peek     print the first n entries without removing them
+//	dequeue  remove and print the first n entries
+//	enqueue  add stdin as an entry
+//	purge    remove all entries
+//	vacuum   rebuild the file to reclaim unused space
+//	decode   print the first n entries as httpq requests
+//
+// When n is omitted it defaults to 1. The password used to decrypt httpq
+// requests is taken from the -pass flag or the QUEUECTL_PASS environment
+// variable.
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/internal/sqlitedb"
+	"github.com/esote/queue/pkg/httpq"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "queuectl:", err)
+		os.Exit(1)
+	}
+}
+
+type ctl struct {
+	file   string
+	format string
+	lines  bool
+	pass   []byte
+	in     io.Reader
+	out    io.Writer
+}
+
+func run(args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("queuectl", flag.ContinueOnError)
+	fs.SetOutput(out)
+	format := fs.String("format", "quote", "entry output format: quote, hex or raw")
+	lines := fs.Bool("lines", false, "enqueue each line of stdin as a separate entry")
+	pass := fs.String("pass", "", "password used to decrypt httpq requests (default $QUEUECTL_PASS)")
+	fs.Usage = func() {
+		fmt.Fprintln(out, "usage: queuectl [flags] command file [n]")
+		fmt.Fprintln(out, "commands: stats, peek, dequeue, enqueue, purge, vacuum, decode")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *pass == "" {
+		// Not the flag's default, which would be printed by usage.
+		*pass = os.Getenv("QUEUECTL_PASS")
+	}
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		fs.Usage()
+		return errors.New("wrong number of arguments")
+	}
+	switch *format {
+	case "quote", "hex", "raw":
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	n := 1
+	if fs.NArg() == 3 {
+		var err error
+		if n, err = strconv.Atoi(fs.Arg(2)); err != nil || n <= 0 {
+			return fmt.Errorf("invalid count %q", fs.Arg(2))
+		}
+	}
+	c := &ctl{
+		file:   fs.Arg(1),
+		format: *format,
+		lines:  *lines,
+		in:     in,
+		out:    out,
+	}
+	if *pass != "" {
+		c.pass = []byte(*pass)
+	}
+	if _, err := os.Stat(c.file); err != nil && fs.Arg(0) != "enqueue" {
+		return err
+	}
+	switch fs.Arg(0) {
+	case "stats":
+		return c.stats()
+	case "peek":
+		return c.peek(n)
+	case "dequeue":
+		return c.dequeue(n)
+	case "enqueue":
+		return c.enqueue()
+	case "purge":
+		return c.exec("DELETE FROM queue")
+	case "vacuum":
+		return c.exec("VACUUM")
+	case "decode":
+		return c.decode(n)
+	default:
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+}
+
+// Open the file the same way queue.NewSqlite3Queue does, so that queue data is
+// securely deleted.
+func (c *ctl) open() (*sql.DB, error) {
+	return sqlitedb.Open(c.file, false)
+}
+
+func (c *ctl) stats() error {
+	db, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var (
+		count    int64
+		first    sql.NullInt64
+		last     sql.NullInt64
+		dataSize sql.NullInt64
+	)
+	err = db.QueryRow(`
+SELECT COUNT(*), MIN(id), MAX(id), SUM(LENGTH(data))
+FROM queue`).Scan(&count, &first, &last, &dataSize)
+	if err != nil {
+		return err
+	}
+	st, err := os.Stat(c.file)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "entries:   %d\n", count)
+	if count > 0 {
+		fmt.Fprintf(c.out, "first id:  %d\n", first.Int64)
+		fmt.Fprintf(c.out, "last id:   %d\n", last.Int64)
+	}
+	fmt.Fprintf(c.out, "data size: %d\n", dataSize.Int64)
+	fmt.Fprintf(c.out, "file size: %d\n", st.Size())
+	return nil
+}
+
+// Call f on the first n entries, oldest first.
+func (c *ctl) entries(n int, f func(id int64, data []byte) error) error {
+	db, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rows, err := db.Query(`
+SELECT id, data
+FROM queue
+ORDER BY id
+LIMIT ?`, n)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id   int64
+			data []byte
+		)
+		if err = rows.Scan(&id, &data); err != nil {
+			return err
+		}
+		if err = f(id, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (c *ctl) peek(n int) error {
+	return c.entries(n, func(id int64, data []byte) error {
+		fmt.Fprintf(c.out, "%d\t", id)
+		return c.print(data)
+	})
+}
+
+func (c *ctl) dequeue(n int) error {
+	q, err := queue.NewSqlite3Queue(c.file)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	for i := 0; i < n; i++ {
+		data, err := q.Dequeue()
+		if err == queue.ErrEmpty {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = c.print(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ctl) enqueue() error {
+	q, err := queue.NewSqlite3Queue(c.file)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	if !c.lines {
+		data, err := ioutil.ReadAll(c.in)
+		if err != nil {
+			return err
+		}
+		return q.Enqueue(data)
+	}
+	s := bufio.NewScanner(c.in)
+	for s.Scan() {
+		if err = q.Enqueue(append([]byte(nil), s.Bytes()...)); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+func (c *ctl) exec(query string) error {
+	db, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(query)
+	return err
+}
+
+func (c *ctl) decode(n int) error {
+	return c.entries(n, func(id int64, data []byte) error {
+		req, retries, err := httpq.Decode(data, c.pass)
+		if err != nil {
+			return fmt.Errorf("entry %d: %s", id, err)
+		}
+		var u string
+		if req.URL != nil {
+			u = req.URL.String()
+		}
+		fmt.Fprintf(c.out, "%d\t%s\t%s\tretries=%d\t", id, req.Method, u,
+			retries)
+		return c.print(req.Body)
+	})
+}
+
+// Print data according to the output format, followed by a newline.
+func (c *ctl) print(data []byte) error {
+	var err error
+	switch c.format {
+	case "quote":
+		_, err = fmt.Fprintln(c.out, strconv.Quote(string(data)))
+	case "hex":
+		_, err = fmt.Fprintln(c.out, hex.EncodeToString(data))
+	case "raw":
+		if _, err = c.out.Write(data); err == nil {
+			_, err = io.WriteString(c.out, "\n")
+		}
+	}
+	return err
+}
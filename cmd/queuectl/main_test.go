@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/internal/tmpdb"
+	"github.com/esote/queue/pkg/httpq"
+)
+
+func TestMain(m *testing.M) {
+	ret := m.Run()
+	tmpdb.Clean()
+	os.Exit(ret)
+}
+
+func ctlRun(t *testing.T, stdin string, args ...string) string {
+	var out bytes.Buffer
+	if err := run(args, strings.NewReader(stdin), &out); err != nil {
+		t.Fatalf("%v: %s", args, err)
+	}
+	return out.String()
+}
+
+func TestCommands(t *testing.T) {
+	file, err := tmpdb.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctlRun(t, "hi", "enqueue", file)
+	ctlRun(t, "hello\nhey\n", "-lines", "enqueue", file)
+	if out := ctlRun(t, "", "stats", file); !strings.Contains(out, "entries:   3\n") {
+		t.Fatalf("unexpected stats %q", out)
+	}
+	if out := ctlRun(t, "", "peek", file, "2"); out != "1\t\"hi\"\n2\t\"hello\"\n" {
+		t.Fatalf("unexpected peek %q", out)
+	}
+	if out := ctlRun(t, "", "-format", "raw", "dequeue", file); out != "hi\n" {
+		t.Fatalf("unexpected dequeue %q", out)
+	}
+	if out := ctlRun(t, "", "-format", "hex", "dequeue", file); out != "68656c6c6f\n" {
+		t.Fatalf("unexpected dequeue %q", out)
+	}
+	ctlRun(t, "", "purge", file)
+	ctlRun(t, "", "vacuum", file)
+	if out := ctlRun(t, "", "dequeue", file); out != "" {
+		t.Fatalf("unexpected dequeue %q", out)
+	}
+	if out := ctlRun(t, "", "stats", file); !strings.Contains(out, "entries:   0\n") {
+		t.Fatalf("unexpected stats %q", out)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	file, err := tmpdb.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite3, err := queue.NewSqlite3Queue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Do not process requests, so that they remain in the file.
+	cfg := &httpq.Config{
+		Workers: 1,
+		Client:  &http.Client{},
+	}
+	q, err := httpq.New(&noDequeue{sqlite3}, []byte("password"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &httpq.Request{
+		Body:   []byte("body"),
+		Method: http.MethodPut,
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   "198.51.100.5", // TEST-NET-2
+			Path:   "/xyz",
+		},
+	}
+	if err = q.Enqueue(req); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sqlite3.Close(); err != nil {
+		t.Fatal(err)
+	}
+	const want = "1\tPUT\thttp://198.51.100.5/xyz\tretries=0\t\"body\"\n"
+	if out := ctlRun(t, "", "-pass", "password", "decode", file); out != want {
+		t.Fatalf("want %q, have %q", want, out)
+	}
+	var out bytes.Buffer
+	if err = run([]string{"-pass", "wrong", "decode", file}, nil, &out); err == nil {
+		t.Fatal("decoded with wrong password")
+	}
+
+	// The password may come from the environment, and is not printed in
+	// usage messages.
+	t.Setenv("QUEUECTL_PASS", "password")
+	if out := ctlRun(t, "", "decode", file); out != want {
+		t.Fatalf("want %q, have %q", want, out)
+	}
+	out.Reset()
+	if err = run([]string{"decode"}, nil, &out); err == nil {
+		t.Fatal("ran without file")
+	}
+	if strings.Contains(out.String(), `"password"`) {
+		t.Fatalf("usage leaks password:\n%s", out.String())
+	}
+}
+
+type noDequeue struct {
+	queue.Queue
+}
+
+func (q *noDequeue) Dequeue() ([]byte, error) {
+	return nil, queue.ErrEmpty
+}
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+)
+
+// ContextHandler operates on data from the async queue like RetryHandler. Ctx
+// is cancelled when the queue is closed, or when the handler runs longer than
+// the queue's Timeout.
+type ContextHandler func(ctx context.Context, data []byte, attempt int) error
+
+// NewContextQueue creates an async queue like NewRetryQueue, whose handler is
+// given a context. A handler running longer than the queue's Timeout has its
+// context cancelled, but its worker still waits for it to return before
+// retrying the data or handling other data, so data is never handled by two
+// calls at once while the queue is open. Workers do not wait for handlers when
+// the queue is closed, so a hung handler does not block Close; it is left
+// running in the background, and its data is added back to the inner queue.
+// That data may then be handled again, by another async queue, while the
+// abandoned call is still running.
+func NewContextQueue(q Queue, handler ContextHandler, cfg *AsyncConfig) (AsyncQueue, error) {
+	if q == nil {
+		return nil, errors.New("queue: async: queue is nil")
+	}
+	if handler == nil {
+		return nil, errors.New("queue: async: handler is nil")
+	}
+	process := func(ctx context.Context, closed <-chan struct{}, data []byte,
+		attempt int) error {
+		type result struct {
+			err   error
+			panic *handlerPanic
+		}
+		done := make(chan result, 1)
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					done <- result{panic: &handlerPanic{
+						v:     v,
+						stack: debug.Stack(),
+					}}
+				}
+			}()
+			done <- result{err: handler(ctx, data, attempt)}
+		}()
+		select {
+		case r := <-done:
+			if r.panic != nil {
+				panic(r.panic)
+			}
+			return r.err
+		case <-closed:
+			return ctx.Err()
+		}
+	}
+	return newRetryAsync(q, process, cfg)
+}
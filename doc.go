@@ -1,3 +1,3 @@
 // Package queue implements a few types of queues. Notably an asynchronous queue
-// for non-blocking data processing and a SQLite3 queue.
+// for non-blocking data processing, a SQLite3 queue and a pure-Go bbolt queue.
 package queue
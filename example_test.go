@@ -1,9 +1,9 @@
 package queue_test
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"time"
 
 	"github.com/esote/queue"
 )
@@ -41,7 +41,9 @@ func ExampleAsyncQueue() {
 
 	// In an async queue, data will be dequeued "eventually." For the
 	// purposes of this example we wait for all of it to be processed.
-	time.Sleep(10 * time.Millisecond)
+	if err = q.Wait(context.Background()); err != nil {
+		log.Fatal(err)
+	}
 
 	// Output: hi
 	// hello
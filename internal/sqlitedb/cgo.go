@@ -0,0 +1,16 @@
+//go:build !purego
+
+package sqlitedb
+
+import (
+	"net/url"
+
+	// SQLite3 driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const driver = "sqlite3"
+
+func secureDelete(query url.Values) {
+	query.Set("_secure_delete", "on")
+}
@@ -0,0 +1,16 @@
+//go:build purego
+
+package sqlitedb
+
+import (
+	"net/url"
+
+	// Pure-Go SQLite3 driver.
+	_ "modernc.org/sqlite"
+)
+
+const driver = "sqlite"
+
+func secureDelete(query url.Values) {
+	query.Add("_pragma", "secure_delete(on)")
+}
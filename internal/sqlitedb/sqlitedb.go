@@ -0,0 +1,34 @@
+// Package sqlitedb opens SQLite3 database files with the driver chosen at build
+// time. By default the cgo driver github.com/mattn/go-sqlite3 is used; the
+// purego build tag selects the pure-Go driver modernc.org/sqlite instead. Both
+// drivers use the same file format.
+package sqlitedb
+
+import (
+	"database/sql"
+	"net/url"
+)
+
+// Open a database file with secure deletion enabled. If create is false, the
+// file must already exist.
+func Open(file string, create bool) (*sql.DB, error) {
+	u := &url.URL{
+		Scheme: "file",
+		Opaque: file,
+	}
+	query := u.Query()
+	secureDelete(query)
+	if !create {
+		query.Set("mode", "rw")
+	}
+	u.RawQuery = query.Encode()
+
+	db, err := sql.Open(driver, u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite3 driver doesn't handle concurrency very well.
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
@@ -0,0 +1,136 @@
+package sqlitedb_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/esote/queue/internal/sqlitedb"
+	"github.com/esote/queue/internal/tmpdb"
+
+	// Both drivers, whichever one sqlitedb uses.
+	_ "github.com/mattn/go-sqlite3"
+	_ "modernc.org/sqlite"
+)
+
+func TestMain(m *testing.M) {
+	ret := m.Run()
+	tmpdb.Clean()
+	os.Exit(ret)
+}
+
+func TestOpen(t *testing.T) {
+	file, err := tmpdb.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlitedb.Open(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var secureDelete int
+	if err = db.QueryRow("PRAGMA secure_delete").Scan(&secureDelete); err != nil {
+		t.Fatal(err)
+	}
+	if secureDelete != 1 {
+		t.Fatal("secure_delete is off")
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	db, err := sqlitedb.Open("missing.db", false)
+	if err == nil {
+		err = db.Ping()
+		_ = db.Close()
+	}
+	if err == nil {
+		_ = os.Remove("missing.db")
+		t.Fatal("opened missing file")
+	}
+}
+
+// The file testdata/queue.db was written by the cgo driver, and must be
+// readable by both drivers.
+func TestFileFormat(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/queue.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := tmpdb.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlitedb.Open(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT data FROM queue ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var datas []string
+	for rows.Next() {
+		var data []byte
+		if err = rows.Scan(&data); err != nil {
+			t.Fatal(err)
+		}
+		datas = append(datas, string(data))
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(datas) != 2 || datas[0] != "hi" || datas[1] != "hello" {
+		t.Fatalf("unexpected data %v", datas)
+	}
+}
+
+// A file written by either driver is readable by the other, whichever driver
+// the package is built with.
+func TestCrossDriver(t *testing.T) {
+	for _, drivers := range [][2]string{
+		{"sqlite3", "sqlite"},
+		{"sqlite", "sqlite3"},
+	} {
+		file, err := tmpdb.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := sql.Open(drivers[0], "file:"+file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Ping(); err != nil {
+			_ = db.Close()
+			// The cgo driver fails to open without cgo.
+			t.Skipf("%s: %v", drivers[0], err)
+		}
+		_, err = db.Exec(`CREATE TABLE t (data BLOB);
+INSERT INTO t(data) VALUES (?)`, []byte(drivers[0]))
+		if err2 := db.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db, err = sql.Open(drivers[1], "file:"+file); err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		err = db.QueryRow("SELECT data FROM t").Scan(&data)
+		_ = db.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", drivers[1], err)
+		}
+		if string(data) != drivers[0] {
+			t.Fatalf("%s read %q written by %s", drivers[1], data,
+				drivers[0])
+		}
+	}
+}
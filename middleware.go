@@ -0,0 +1,167 @@
+package queue
+
+import (
+	"crypto/sha256"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a handler to add behaviour before or after it.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h in middlewares, so that the first middleware is called first.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Logging logs dequeue errors, and the size of data handled along with how
+// long handling it took. A nil logger uses the standard logger.
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next Handler) Handler {
+		return func(data []byte, err error) {
+			if err != nil {
+				logger.Printf("queue: %s", err)
+				next(data, err)
+				return
+			}
+			start := time.Now()
+			next(data, err)
+			logger.Printf("queue: handled %d bytes in %s", len(data),
+				time.Since(start))
+		}
+	}
+}
+
+// Timing calls observe with how long each call to the handler took, including
+// calls which panic.
+func Timing(observe func(d time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return func(data []byte, err error) {
+			start := time.Now()
+			defer func() {
+				observe(time.Since(start))
+			}()
+			next(data, err)
+		}
+	}
+}
+
+// Recover recovers panics in the handler, calling onPanic with the recovered
+// value, the stack trace and the data being handled. A nil onPanic ignores
+// panics.
+func Recover(onPanic func(v interface{}, stack []byte, data []byte)) Middleware {
+	return func(next Handler) Handler {
+		return func(data []byte, err error) {
+			defer func() {
+				if v := recover(); v != nil && onPanic != nil {
+					onPanic(v, debug.Stack(), data)
+				}
+			}()
+			next(data, err)
+		}
+	}
+}
+
+// Decode replaces data with the result of decode, such as decompressing or
+// decrypting it. When decode fails, the handler is called with nil data and
+// a *DecodeError.
+func Decode(decode func(data []byte) ([]byte, error)) Middleware {
+	return func(next Handler) Handler {
+		return func(data []byte, err error) {
+			if err != nil {
+				next(data, err)
+				return
+			}
+			decoded, err := decode(data)
+			if err != nil {
+				next(nil, &DecodeError{
+					Data: data,
+					Err:  err,
+				})
+				return
+			}
+			next(decoded, nil)
+		}
+	}
+}
+
+// Dedup drops data identical to any of the last size items handled. Key
+// returns what identifies data; when nil, the data itself is used. Data is not
+// remembered when the next handler panics.
+func Dedup(size int, key func(data []byte) []byte) Middleware {
+	if key == nil {
+		key = func(data []byte) []byte {
+			return data
+		}
+	}
+	if size < 1 {
+		size = 1
+	}
+	var (
+		mu     sync.Mutex
+		recent = make([][sha256.Size]byte, 0, size)
+		seen   = make(map[[sha256.Size]byte]int, size)
+	)
+	// Record the sum of data, reporting whether it was already recent.
+	dup := func(sum [sha256.Size]byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if seen[sum] > 0 {
+			return true
+		}
+		if len(recent) == size {
+			old := recent[0]
+			if seen[old]--; seen[old] == 0 {
+				delete(seen, old)
+			}
+			recent = append(recent[:0], recent[1:]...)
+		}
+		recent = append(recent, sum)
+		seen[sum]++
+		return false
+	}
+	// Forget the latest record of sum, so that it is not a duplicate.
+	forget := func(sum [sha256.Size]byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		for i := len(recent) - 1; i >= 0; i-- {
+			if recent[i] != sum {
+				continue
+			}
+			recent = append(recent[:i], recent[i+1:]...)
+			if seen[sum]--; seen[sum] == 0 {
+				delete(seen, sum)
+			}
+			return
+		}
+	}
+	return func(next Handler) Handler {
+		return func(data []byte, err error) {
+			if err != nil {
+				next(data, err)
+				return
+			}
+			sum := sha256.Sum256(key(data))
+			if dup(sum) {
+				return
+			}
+			// Data whose handler panicked may be enqueued again.
+			handled := false
+			defer func() {
+				if !handled {
+					forget(sum)
+				}
+			}()
+			next(data, err)
+			handled = true
+		}
+	}
+}
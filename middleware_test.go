@@ -0,0 +1,153 @@
+package queue_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mw := func(name string) queue.Middleware {
+		return func(next queue.Handler) queue.Handler {
+			return func(data []byte, err error) {
+				calls = append(calls, name)
+				next(data, err)
+			}
+		}
+	}
+	h := queue.Chain(func(data []byte, err error) {
+		calls = append(calls, "handler")
+	}, mw("a"), mw("b"))
+	h(nil, nil)
+	if strings.Join(calls, ",") != "a,b,handler" {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	var durations []time.Duration
+	var panicked []byte
+	var handled [][]byte
+	var errs []error
+	h := queue.Chain(func(data []byte, err error) {
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		if string(data) == "PANIC" {
+			panic("boom")
+		}
+		handled = append(handled, data)
+	},
+		queue.Logging(log.New(&buf, "", 0)),
+		queue.Timing(func(d time.Duration) {
+			durations = append(durations, d)
+		}),
+		queue.Recover(func(v interface{}, stack, data []byte) {
+			panicked = data
+		}),
+		queue.Decode(func(data []byte) ([]byte, error) {
+			if len(data) == 0 {
+				return nil, errors.New("empty")
+			}
+			return bytes.ToUpper(data), nil
+		}),
+		queue.Dedup(2, nil))
+
+	for _, data := range []string{"a", "b", "a", "c", "a", "", "panic"} {
+		h([]byte(data), nil)
+	}
+	h(nil, queue.ErrEmpty)
+
+	// The second "a" is a duplicate, the third is not.
+	want := []string{"A", "B", "C", "A"}
+	if len(handled) != len(want) {
+		t.Fatalf("handled %q", handled)
+	}
+	for i := range want {
+		if string(handled[i]) != want[i] {
+			t.Fatalf("handled %q", handled)
+		}
+	}
+	var derr *queue.DecodeError
+	if len(errs) != 2 || !errors.As(errs[0], &derr) ||
+		errs[1] != queue.ErrEmpty {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	// Recover sees the data before it is decoded.
+	if string(panicked) != "panic" {
+		t.Fatalf("panic not recovered: %q", panicked)
+	}
+	if len(durations) != 8 {
+		t.Fatalf("timed %d calls", len(durations))
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 8 {
+		t.Fatalf("logged %d lines:\n%s", lines, buf.String())
+	}
+}
+
+func TestAsyncMiddleware(t *testing.T) {
+	done := make(chan []byte, 1)
+	handler := func(data []byte, err error) {
+		done <- data
+	}
+	cfg := &queue.AsyncConfig{
+		Workers: 1,
+		Middleware: []queue.Middleware{
+			queue.Decode(func(data []byte) ([]byte, error) {
+				return bytes.ToUpper(data), nil
+			}),
+		},
+	}
+	q, err := queue.NewAsyncQueueConfig(queue.NewMemoryQueue(), handler, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.Enqueue([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-done; string(data) != "A" {
+		t.Fatalf("want A, have %q", data)
+	}
+}
+
+// Data is not a duplicate of data whose handler panicked.
+func TestDedupPanic(t *testing.T) {
+	var handled int
+	h := queue.Chain(func(data []byte, err error) {
+		if handled++; handled == 1 {
+			panic("boom")
+		}
+	},
+		queue.Recover(nil),
+		queue.Dedup(2, nil))
+	for i := 0; i < 3; i++ {
+		h([]byte("a"), nil)
+	}
+	if handled != 2 {
+		t.Fatalf("handled %d times", handled)
+	}
+}
+
+// Middleware cannot wrap handlers which return errors.
+func TestRetryMiddleware(t *testing.T) {
+	cfg := &queue.AsyncConfig{
+		Workers:    1,
+		Middleware: []queue.Middleware{queue.Logging(nil)},
+	}
+	handler := func(data []byte, attempt int) error {
+		return nil
+	}
+	if _, err := queue.NewRetryQueue(queue.NewMemoryQueue(), handler,
+		cfg); err == nil {
+		t.Fatal("middleware ignored")
+	}
+}
@@ -0,0 +1,104 @@
+package queue
+
+import (
+	"errors"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// PanicHandler is called when a handler panics, with the recovered value, the
+// stack trace of the panic and the data being handled. Data is nil if the
+// panic happened while dequeuing.
+type PanicHandler func(v interface{}, stack []byte, data []byte)
+
+// PanicAction decides what happens to data whose handler panicked.
+type PanicAction int
+
+const (
+	// Discard the data.
+	PanicDiscard PanicAction = iota
+
+	// Add the data back to the inner queue. Data which always causes a
+	// panic will be handled again and again.
+	PanicRequeue
+
+	// Add the data to the dead letter queue.
+	PanicDeadLetter
+)
+
+// PanicConfig is used to configure how handler panics are dealt with.
+type PanicConfig struct {
+	// Called for each panic, if not nil.
+	Handler PanicHandler
+
+	// What happens to the data.
+	Action PanicAction
+
+	// Queue receiving data when Action is PanicDeadLetter. Package jobs
+	// also adds jobs it cannot run here, whatever the Action.
+	DeadLetter Queue
+}
+
+func (cfg *PanicConfig) check() error {
+	switch cfg.Action {
+	case PanicDiscard, PanicRequeue:
+	case PanicDeadLetter:
+		if cfg.DeadLetter == nil {
+			return errors.New("queue: async: dead letter queue is nil")
+		}
+	default:
+		return errors.New("queue: async: unknown panic action")
+	}
+	return nil
+}
+
+// Panic recovered from a handler running in another goroutine.
+type handlerPanic struct {
+	v     interface{}
+	stack []byte
+}
+
+// Deal with a panic recovered while handling it, which is nil if the panic
+// happened while dequeuing.
+func (q *async) panicked(v interface{}, it *item) {
+	atomic.AddUint64(&q.stats.panicked, 1)
+	if it != nil {
+		q.breaker.record(false)
+	}
+	if q.panic == nil {
+		return
+	}
+	stack := debug.Stack()
+	if p, ok := v.(*handlerPanic); ok {
+		v, stack = p.v, p.stack
+	}
+	var data []byte
+	if it != nil {
+		data = it.data
+	}
+	if q.panic.Handler != nil {
+		func() {
+			// The panic handler must not stop the worker either.
+			defer func() {
+				_ = recover()
+			}()
+			q.panic.Handler(v, stack, data)
+		}()
+	}
+	if it == nil {
+		return
+	}
+	var err error
+	switch q.panic.Action {
+	case PanicRequeue:
+		if err = q.q.Enqueue(data); err == nil {
+			q.idle.enqueue()
+			q.wake()
+		}
+	case PanicDeadLetter:
+		err = q.panic.DeadLetter.Enqueue(data)
+	}
+	if err != nil {
+		q.report(err)
+	}
+}
@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+)
+
+// PartitionedQueue processes queue data asynchronously while preserving the
+// order of data sharing a key.
+type PartitionedQueue interface {
+	// Add data to the queue. Data with the same key is handled
+	// sequentially, in the order it was added. Safe for concurrent use.
+	Enqueue(key string, data []byte) error
+
+	// Close the queue. Can be done at any point after the queue is
+	// constructed.
+	io.Closer
+}
+
+type partitioned struct {
+	parts []AsyncQueue
+}
+
+// NewPartitionedQueue creates a queue that assigns each key to one of the inner
+// queues, and processes every inner queue through the handler with its own
+// worker. Data with different keys is handled in parallel, unless the keys
+// share a partition. Keys are assigned by hash, so the inner queues must be
+// given in the same order every time to keep data ordered across restarts.
+// Closing the partitioned queue does NOT close the inner queues.
+func NewPartitionedQueue(qs []Queue, handler Handler) (PartitionedQueue, error) {
+	if len(qs) == 0 {
+		return nil, errors.New("queue: partitioned: no queues")
+	}
+	pq := &partitioned{
+		parts: make([]AsyncQueue, 0, len(qs)),
+	}
+	for _, q := range qs {
+		aq, err := NewAsyncQueue(q, handler, 1)
+		if err != nil {
+			_ = pq.Close()
+			return nil, err
+		}
+		pq.parts = append(pq.parts, aq)
+	}
+	return pq, nil
+}
+
+func (q *partitioned) Enqueue(key string, data []byte) error {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return q.parts[h.Sum32()%uint32(len(q.parts))].Enqueue(data)
+}
+
+func (q *partitioned) Close() error {
+	var err error
+	for _, part := range q.parts {
+		if err2 := part.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package queue_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/internal/tmpdb"
+)
+
+func TestPartitioned(t *testing.T) {
+	const parts = 3
+	memory := make([]queue.Queue, parts)
+	sqlite3 := make([]queue.Queue, parts)
+	for i := 0; i < parts; i++ {
+		memory[i] = queue.NewMemoryQueue()
+		file, err := tmpdb.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sqlite3[i], err = queue.NewSqlite3Queue(file); err != nil {
+			t.Fatal(err)
+		}
+		defer sqlite3[i].Close()
+	}
+	for name, qs := range map[string][]queue.Queue{
+		"memory":  memory,
+		"sqlite3": sqlite3,
+	} {
+		if err := testPartitioned(qs); err != nil {
+			t.Fatalf("queue: %s: %s", name, err)
+		}
+	}
+}
+
+func testPartitioned(qs []queue.Queue) error {
+	const (
+		keys = 8
+		n    = 20
+	)
+	var (
+		mu     sync.Mutex
+		next   [keys]uint32
+		active [keys]bool
+		err    error
+		done   = make(chan struct{}, keys*n)
+	)
+	handler := func(data []byte, err2 error) {
+		defer func() {
+			done <- struct{}{}
+		}()
+		key, seq := data[0], binary.BigEndian.Uint32(data[1:])
+		mu.Lock()
+		if err2 == nil && active[key] {
+			err2 = fmt.Errorf("key %d handled concurrently", key)
+		}
+		if err2 == nil && next[key] != seq {
+			err2 = fmt.Errorf("key %d: want %d, have %d", key,
+				next[key], seq)
+		}
+		if err2 != nil && err == nil {
+			err = err2
+		}
+		next[key]++
+		active[key] = true
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		active[key] = false
+		mu.Unlock()
+	}
+	q, err := queue.NewPartitionedQueue(qs, handler)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	for seq := uint32(0); seq < n; seq++ {
+		for key := byte(0); key < keys; key++ {
+			data := make([]byte, 5)
+			data[0] = key
+			binary.BigEndian.PutUint32(data[1:], seq)
+			if err := q.Enqueue(fmt.Sprint("key", key), data); err != nil {
+				return err
+			}
+		}
+	}
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	for i := 0; i < keys*n; i++ {
+		select {
+		case <-done:
+		case <-timer.C:
+			return fmt.Errorf("only %d of %d handled", i, keys*n)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return err
+}
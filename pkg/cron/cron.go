@@ -0,0 +1,190 @@
+// Package cron enqueues payloads into queues on recurring schedules given as
+// cron expressions, remembering when each job last ran so that runs missed
+// while the scheduler was down can be detected.
+//
+// Expressions have five fields separated by spaces: minute (0-59), hour
+// (0-23), day of month (1-31), month (1-12 or JAN-DEC) and day of week (0-7 or
+// SUN-SAT, where both 0 and 7 are Sunday). Each field is "*", a value, a range
+// "a-b", or a comma-separated list of these, any of which may be followed by
+// "/step". As in traditional cron, when both day fields are restricted a day
+// matching either of them is used. The macros @yearly, @annually, @monthly,
+// @weekly, @daily, @midnight and @hourly are also accepted.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day fields start with "*".
+	domStar, dowStar bool
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    []string // names of values starting at min
+}
+
+var fields = [5]field{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun",
+		"jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri",
+		"sat"}},
+}
+
+// Parse a cron expression.
+func Parse(expr string) (*Schedule, error) {
+	if macro, ok := macros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron: %q: want %d fields, have %d", expr,
+			len(fields), len(parts))
+	}
+	var bits [len(fields)]uint64
+	for i, part := range parts {
+		var err error
+		if bits[i], err = fields[i].parse(part); err != nil {
+			return nil, fmt.Errorf("cron: %q: %s", expr, err)
+		}
+	}
+	// Sunday is both 0 and 7.
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &Schedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: strings.HasPrefix(parts[2], "*"),
+		dowStar: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// Parse a field into a bit set of its values.
+func (f *field) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("%s: invalid step %q", f.name,
+					stepStr)
+			}
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(loStr); err != nil {
+				return 0, err
+			}
+			switch {
+			case isRange:
+				if hi, err = f.value(hiStr); err != nil {
+					return 0, err
+				}
+			case !hasStep:
+				hi = lo
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("%s: invalid range %q", f.name,
+					rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (f *field) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s: invalid value %q", f.name, s)
+	}
+	return v, nil
+}
+
+// Next returns the first time matching the schedule strictly after t, in t's
+// location. Returns the zero time if there is none within five years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0,
+		loc).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = advance(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0,
+				0, 0, loc))
+		case !s.day(t):
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day()+1,
+				0, 0, 0, 0, loc))
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day(),
+				t.Hour()+1, 0, 0, 0, loc))
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Move from t to next, making progress even when daylight saving time maps
+// next back to t or before it.
+func advance(t, next time.Time) time.Time {
+	if !next.After(t) {
+		return t.Truncate(time.Hour).Add(time.Hour)
+	}
+	return next
+}
+
+func (s *Schedule) day(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.domStar && s.dowStar:
+		return true
+	case s.domStar:
+		return dow
+	case s.dowStar:
+		return dom
+	default:
+		return dom || dow
+	}
+}
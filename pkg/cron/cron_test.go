@@ -0,0 +1,237 @@
+package cron_test
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/internal/sqlitedb"
+	"github.com/esote/queue/internal/tmpdb"
+	"github.com/esote/queue/pkg/cron"
+)
+
+func TestMain(m *testing.M) {
+	ret := m.Run()
+	tmpdb.Clean()
+	os.Exit(ret)
+}
+
+func TestNext(t *testing.T) {
+	// A Wednesday.
+	from := time.Date(2020, time.January, 1, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2020, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2020, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{"5,10 0 * * *", time.Date(2020, 1, 2, 0, 5, 0, 0, time.UTC)},
+		{"0 0 * * MON", time.Date(2020, 1, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 FEB *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted.
+		{"0 0 15 * FRI", time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		s, err := cron.Parse(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := s.Next(from); !have.Equal(test.want) {
+			t.Fatalf("%s: want %s, have %s", test.expr, test.want,
+				have)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	exprs := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@often",
+	}
+	for _, expr := range exprs {
+		if _, err := cron.Parse(expr); err == nil {
+			t.Fatalf("%q parsed", expr)
+		}
+	}
+}
+
+// Missed runs are detected from the last run time in the database.
+func TestMissed(t *testing.T) {
+	policies := map[cron.Policy]int{
+		cron.Skip:        0,
+		cron.CatchUpOnce: 1,
+		cron.CatchUpAll:  5,
+	}
+	for policy, want := range policies {
+		file, err := tmpdb.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := queue.NewMemoryQueue()
+		job := cron.Job{
+			Name:     "hourly",
+			Schedule: "@hourly",
+			Queue:    q,
+			Payload:  []byte("run"),
+			Missed:   policy,
+		}
+		// Hours are truncated in UTC below.
+		cfg := &cron.Config{
+			Location: time.UTC,
+		}
+		s, err := cron.New(file, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first run of a job has nothing to catch up on.
+		if err = s.Add(job); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := q.(queue.Lener).Len(); n != 0 {
+			t.Fatalf("policy %d: %d runs enqueued", policy, n)
+		}
+
+		// Pretend the scheduler has been down for five hours.
+		db, err := sqlitedb.Open(file, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := time.Now().Truncate(time.Hour).Add(-5*time.Hour + time.Second)
+		if _, err = db.Exec("UPDATE runs SET last = ?",
+			last.UnixNano()); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if s, err = cron.New(file, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Add(job); err != nil {
+			t.Fatal(err)
+		}
+		next := time.Now().Truncate(time.Hour).Add(time.Hour)
+		if have := s.Next(job.Name); !have.Equal(next) {
+			t.Fatalf("next run at %s, want %s", have, next)
+		}
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := q.(queue.Lener).Len(); n != want {
+			t.Fatalf("policy %d: want %d runs, have %d", policy, want,
+				n)
+		}
+	}
+}
+
+// Runs missed while the scheduler runs, such as when the process is suspended,
+// are dealt with by the job's policy.
+func TestMissedRunning(t *testing.T) {
+	policies := map[cron.Policy]int{
+		cron.Skip:        1,
+		cron.CatchUpOnce: 2,
+		cron.CatchUpAll:  5,
+	}
+	for policy, want := range policies {
+		file, err := tmpdb.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		now := time.Date(2020, 1, 1, 10, 30, 0, 0, time.UTC)
+		cfg := &cron.Config{
+			Location: time.UTC,
+			Now: func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			},
+		}
+		s, err := cron.New(file, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := queue.NewMemoryQueue()
+		if err = s.Add(cron.Job{
+			Name:     "hourly",
+			Schedule: "@hourly",
+			Queue:    q,
+			Missed:   policy,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// Jump past five runs, waking the scheduler.
+		mu.Lock()
+		now = now.Add(5 * time.Hour)
+		mu.Unlock()
+		s.Remove("missing")
+		for i := 0; ; i++ {
+			if n, _ := q.(queue.Lener).Len(); n == want {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("policy %d: runs not enqueued", policy)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := q.(queue.Lener).Len(); n != want {
+			t.Fatalf("policy %d: want %d runs, have %d", policy, want,
+				n)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	file, err := tmpdb.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := cron.New(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := []cron.Job{
+		{Schedule: "* * * * *", Queue: queue.NewMemoryQueue()},
+		{Name: "a", Schedule: "* * * * *"},
+		{Name: "a", Schedule: "* *", Queue: queue.NewMemoryQueue()},
+	}
+	for _, job := range bad {
+		if err = s.Add(job); err == nil {
+			t.Fatalf("added %+v", job)
+		}
+	}
+	if s.Remove("a") {
+		t.Fatal("removed missing job")
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add(cron.Job{Name: "a", Schedule: "* * * * *",
+		Queue: queue.NewMemoryQueue()}); err != cron.ErrClosed {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
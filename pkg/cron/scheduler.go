@@ -0,0 +1,372 @@
+package cron
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/internal/sqlitedb"
+)
+
+// Policy decides what happens to runs missed while the scheduler was down.
+type Policy int
+
+const (
+	// Skip missed runs.
+	Skip Policy = iota
+
+	// Enqueue the payload once if any runs were missed.
+	CatchUpOnce
+
+	// Enqueue the payload once for every missed run.
+	CatchUpAll
+)
+
+// Runs to enqueue out of missed runs, given in order.
+func (p Policy) filter(missed []time.Time) []time.Time {
+	switch {
+	case len(missed) == 0 || p == CatchUpAll:
+		return missed
+	case p == CatchUpOnce:
+		return missed[len(missed)-1:]
+	default:
+		return nil
+	}
+}
+
+// Job enqueues a payload into a queue on a schedule.
+type Job struct {
+	// Name identifying the job's last run time in the database.
+	Name string
+
+	// Cron expression, see Parse.
+	Schedule string
+
+	Queue   queue.Queue
+	Payload []byte
+
+	// What happens to runs missed before the job was added, or while the
+	// process was suspended.
+	Missed Policy
+}
+
+// Config is used to configure the scheduler.
+type Config struct {
+	// Location in which schedules are evaluated. Nil means time.Local.
+	Location *time.Location
+
+	// Receives errors from enqueuing payloads and recording run times.
+	// Errors are dropped if the channel is nil or full.
+	Errors chan<- error
+
+	// Returns the current time. Nil means time.Now.
+	Now func() time.Time
+}
+
+type job struct {
+	Job
+	sched *Schedule
+	next  time.Time
+}
+
+// Scheduler enqueues the payloads of jobs when their schedules fire.
+type Scheduler struct {
+	db     *sql.DB
+	st     map[string]*sql.Stmt
+	loc    *time.Location
+	errors chan<- error
+	now    func() time.Time
+
+	mu      sync.Mutex
+	jobs    map[string]*job
+	changed chan struct{}
+	closed  bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// ErrClosed is returned when using a closed scheduler.
+var ErrClosed = errors.New("cron: scheduler is closed")
+
+// New creates a scheduler recording the last run time of each job in the
+// SQLite3 database file. When a nil config is given, reasonable defaults will
+// be used.
+func New(file string, cfg *Config) (*Scheduler, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	db, err := sqlitedb.Open(file, true)
+	if err != nil {
+		return nil, err
+	}
+
+	const qCreate = `
+CREATE TABLE IF NOT EXISTS runs (
+	name TEXT PRIMARY KEY,
+	last INTEGER NOT NULL
+)`
+
+	s := &Scheduler{
+		db:      db,
+		st:      make(map[string]*sql.Stmt),
+		loc:     cfg.Location,
+		errors:  cfg.Errors,
+		now:     cfg.Now,
+		jobs:    make(map[string]*job),
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if s.loc == nil {
+		s.loc = time.Local
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	if _, err = s.db.Exec(qCreate); err != nil {
+		_ = s.closeDB()
+		return nil, err
+	}
+	if err = s.statements(); err != nil {
+		_ = s.closeDB()
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *Scheduler) statements() error {
+	var err error
+
+	// Last run of a job.
+	s.st["last"], err = s.db.Prepare(`
+SELECT last
+FROM runs
+WHERE name = ?`)
+	if err != nil {
+		return err
+	}
+
+	// Record a run.
+	s.st["record"], err = s.db.Prepare(`
+INSERT INTO runs(name, last)
+VALUES (?, ?)
+ON CONFLICT(name) DO UPDATE SET last = excluded.last`)
+	return err
+}
+
+// Add a job, replacing any job with the same name. Runs missed since the job
+// last ran, according to the database, are dealt with by its Missed policy.
+// Jobs which never ran have no missed runs.
+func (s *Scheduler) Add(j Job) error {
+	if j.Name == "" {
+		return errors.New("cron: job name is empty")
+	}
+	if j.Queue == nil {
+		return errors.New("cron: job queue is nil")
+	}
+	sched, err := Parse(j.Schedule)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	now := s.now().In(s.loc)
+	var last int64
+	err = s.st["last"].QueryRow(j.Name).Scan(&last)
+	switch {
+	case err == sql.ErrNoRows:
+		if err = s.record(j.Name, now); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		if err = s.catchUp(&j, sched, time.Unix(0, last).In(s.loc),
+			now); err != nil {
+			return err
+		}
+	}
+	s.jobs[j.Name] = &job{
+		Job:   j,
+		sched: sched,
+		next:  sched.Next(now),
+	}
+	s.notify()
+	return nil
+}
+
+// Deal with runs missed between last and now.
+func (s *Scheduler) catchUp(j *Job, sched *Schedule, last, now time.Time) error {
+	var missed []time.Time
+	for t := sched.Next(last); !t.IsZero() && !t.After(now); t = sched.Next(t) {
+		missed = append(missed, t)
+	}
+	missed = j.Missed.filter(missed)
+	for _, t := range missed {
+		if err := j.Queue.Enqueue(j.Payload); err != nil {
+			return fmt.Errorf("cron: %s: %w", j.Name, err)
+		}
+		if err := s.record(j.Name, t); err != nil {
+			return err
+		}
+	}
+	if len(missed) == 0 {
+		return s.record(j.Name, now)
+	}
+	return nil
+}
+
+// Remove the job with name, reporting whether it existed. Its last run time is
+// kept.
+func (s *Scheduler) Remove(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.jobs[name]
+	delete(s.jobs, name)
+	s.notify()
+	return ok
+}
+
+// Next returns when the job with name next runs, or the zero time if there is
+// no such job.
+func (s *Scheduler) Next(name string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[name]; ok {
+		return j.next
+	}
+	return time.Time{}
+}
+
+// Close the scheduler. Does NOT close job queues.
+func (s *Scheduler) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+	s.wg.Wait()
+	return s.closeDB()
+}
+
+func (s *Scheduler) closeDB() error {
+	var err error
+	for _, stmt := range s.st {
+		if err2 := stmt.Close(); err == nil {
+			err = err2
+		}
+	}
+	if err2 := s.db.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Wake the run loop. Must be called with mu held.
+func (s *Scheduler) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) record(name string, t time.Time) error {
+	_, err := s.st["record"].Exec(name, t.UnixNano())
+	return err
+}
+
+func (s *Scheduler) report(err error) {
+	select {
+	case s.errors <- err:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	defer s.wg.Done()
+	for {
+		var timer *time.Timer
+		var due <-chan time.Time
+		if next := s.earliest(); !next.IsZero() {
+			timer = time.NewTimer(next.Sub(s.now()))
+			due = timer.C
+		}
+		select {
+		case <-due:
+			s.fire()
+		case <-s.changed:
+		case <-s.done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+	}
+}
+
+// Time of the next run of any job.
+func (s *Scheduler) earliest() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next time.Time
+	for _, j := range s.jobs {
+		if !j.next.IsZero() && (next.IsZero() || j.next.Before(next)) {
+			next = j.next
+		}
+	}
+	return next
+}
+
+// Enqueue payloads of all jobs which are due. When several runs of a job are
+// due, because the process was suspended or the clock jumped, the latest is run
+// and the others are missed runs dealt with by the job's Missed policy.
+func (s *Scheduler) fire() {
+	type run struct {
+		Job
+		times []time.Time
+	}
+	var runs []run
+	s.mu.Lock()
+	now := s.now().In(s.loc)
+	for _, j := range s.jobs {
+		var due []time.Time
+		for !j.next.IsZero() && !j.next.After(now) {
+			due = append(due, j.next)
+			j.next = j.sched.Next(j.next)
+		}
+		if len(due) == 0 {
+			continue
+		}
+		last := len(due) - 1
+		runs = append(runs, run{
+			Job:   j.Job,
+			times: append(j.Missed.filter(due[:last]), due[last]),
+		})
+	}
+	s.mu.Unlock()
+	// Queues are not used with mu held, so that a slow queue does not
+	// block other methods.
+	for _, r := range runs {
+		for _, t := range r.times {
+			if err := r.Queue.Enqueue(r.Payload); err != nil {
+				s.report(fmt.Errorf("cron: %s: %w", r.Name, err))
+			} else if err = s.record(r.Name, t); err != nil {
+				s.report(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package faultq wraps queues to inject failures, for testing how code behaves
+// when its queue fails intermittently.
+package faultq
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/esote/queue"
+)
+
+// ErrInjected is returned by injected failures.
+var ErrInjected = errors.New("faultq: injected failure")
+
+// Config is used to configure which failures are injected. Rates are
+// probabilities between 0 and 1.
+type Config struct {
+	// Seed of the random source deciding when failures happen. The same
+	// seed and sequence of calls gives the same failures.
+	Seed int64
+
+	// Rate at which Enqueue fails without adding data.
+	EnqueueErrorRate float64
+
+	// Rate at which Dequeue fails without removing data.
+	DequeueErrorRate float64
+
+	// Rate at which Dequeue removes data but returns a corrupted copy of
+	// it, with one byte changed.
+	CorruptRate float64
+
+	// Rate at which Enqueue and Dequeue panic.
+	PanicRate float64
+
+	// Latency added to every Enqueue and Dequeue, plus a random amount up
+	// to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+}
+
+// Stats counts injected failures.
+type Stats struct {
+	EnqueueErrors int
+	DequeueErrors int
+	Corruptions   int
+	Panics        int
+}
+
+// Queue injects failures into an inner queue. Queues wrapping a queue.Lener
+// also implement queue.Lener.
+type Queue interface {
+	queue.Queue
+
+	// Stats returns the number of failures injected so far.
+	Stats() Stats
+}
+
+type faulty struct {
+	q   queue.Queue
+	cfg Config
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	stats Stats
+}
+
+// New wraps q, injecting failures as configured by cfg. When a nil config is
+// given, no failures are injected. Closing the queue closes q.
+func New(q queue.Queue, cfg *Config) Queue {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	f := &faulty{
+		q:    q,
+		cfg:  *cfg,
+		rand: rand.New(rand.NewSource(cfg.Seed)),
+	}
+	if _, ok := q.(queue.Lener); ok {
+		return &lener{f}
+	}
+	return f
+}
+
+// Wraps a queue.Lener.
+type lener struct {
+	*faulty
+}
+
+// Len returns the length of the inner queue.
+func (q *lener) Len() (int, error) {
+	return q.q.(queue.Lener).Len()
+}
+
+// Decision made for one call.
+type fault struct {
+	err     bool
+	corrupt bool
+	panic   bool
+	delay   time.Duration
+	pos     int
+}
+
+func (q *faulty) decide(errRate float64, enqueue bool) fault {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// Always draw the same numbers, so that changing one rate does not
+	// shift the decisions made for the others.
+	var f fault
+	f.panic = q.rand.Float64() < q.cfg.PanicRate
+	f.err = q.rand.Float64() < errRate
+	f.corrupt = q.rand.Float64() < q.cfg.CorruptRate && !enqueue
+	f.pos = q.rand.Int()
+	f.delay = q.cfg.Latency
+	if q.cfg.Jitter > 0 {
+		f.delay += time.Duration(q.rand.Int63n(int64(q.cfg.Jitter)))
+	}
+	switch {
+	case f.panic:
+		q.stats.Panics++
+	case f.err && enqueue:
+		q.stats.EnqueueErrors++
+	case f.err:
+		q.stats.DequeueErrors++
+	}
+	return f
+}
+
+// Enqueue adds data to the inner queue, unless a failure is injected.
+func (q *faulty) Enqueue(data []byte) error {
+	f := q.decide(q.cfg.EnqueueErrorRate, true)
+	time.Sleep(f.delay)
+	if f.panic {
+		panic(ErrInjected)
+	}
+	if f.err {
+		return ErrInjected
+	}
+	return q.q.Enqueue(data)
+}
+
+// Dequeue removes data from the inner queue, unless a failure is injected.
+func (q *faulty) Dequeue() ([]byte, error) {
+	f := q.decide(q.cfg.DequeueErrorRate, false)
+	time.Sleep(f.delay)
+	if f.panic {
+		panic(ErrInjected)
+	}
+	if f.err {
+		return nil, ErrInjected
+	}
+	data, err := q.q.Dequeue()
+	if err != nil || !f.corrupt || len(data) == 0 {
+		return data, err
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[f.pos%len(corrupt)] ^= 0xff
+	q.mu.Lock()
+	q.stats.Corruptions++
+	q.mu.Unlock()
+	return corrupt, nil
+}
+
+// Close the inner queue.
+func (q *faulty) Close() error {
+	return q.q.Close()
+}
+
+func (q *faulty) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
@@ -0,0 +1,167 @@
+package faultq_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/pkg/faultq"
+	"github.com/esote/queue/pkg/queuetest"
+)
+
+func TestConformance(t *testing.T) {
+	queuetest.Run(t, func() (queue.Queue, error) {
+		return faultq.New(queue.NewMemoryQueue(), nil), nil
+	})
+}
+
+// Record which of n enqueues fail.
+func failures(cfg *faultq.Config, n int) []bool {
+	q := faultq.New(queue.NewMemoryQueue(), cfg)
+	fails := make([]bool, n)
+	for i := range fails {
+		fails[i] = q.Enqueue(nil) == faultq.ErrInjected
+	}
+	return fails
+}
+
+func TestDeterministic(t *testing.T) {
+	cfg := &faultq.Config{
+		Seed:             42,
+		EnqueueErrorRate: 0.5,
+	}
+	a, b := failures(cfg, 100), failures(cfg, 100)
+	n := 0
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatal("same seed gives different failures")
+		}
+		if a[i] {
+			n++
+		}
+	}
+	if n == 0 || n == len(a) {
+		t.Fatalf("%d of %d enqueues failed", n, len(a))
+	}
+}
+
+func TestDequeueError(t *testing.T) {
+	inner := queue.NewMemoryQueue()
+	q := faultq.New(inner, &faultq.Config{DequeueErrorRate: 1})
+	if err := q.Enqueue([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Dequeue(); err != faultq.ErrInjected {
+		t.Fatalf("want ErrInjected, have %v", err)
+	}
+	// The data was not removed.
+	if data, err := inner.Dequeue(); err != nil || string(data) != "x" {
+		t.Fatalf("unexpected inner data %q (%v)", data, err)
+	}
+	if stats := q.Stats(); stats.DequeueErrors != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	q := faultq.New(queue.NewMemoryQueue(), &faultq.Config{CorruptRate: 1})
+	want := []byte("data")
+	if err := q.Enqueue(want); err != nil {
+		t.Fatal(err)
+	}
+	data, err := q.Dequeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != len(want) || bytes.Equal(data, want) {
+		t.Fatalf("data not corrupted: %q", data)
+	}
+	if string(want) != "data" {
+		t.Fatal("enqueued data modified")
+	}
+}
+
+func TestPanicLatency(t *testing.T) {
+	q := faultq.New(queue.NewMemoryQueue(), &faultq.Config{
+		PanicRate: 1,
+		Latency:   10 * time.Millisecond,
+	})
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != faultq.ErrInjected {
+			t.Fatalf("want ErrInjected panic, have %v", r)
+		}
+		if time.Since(start) < 10*time.Millisecond {
+			t.Fatal("no latency injected")
+		}
+	}()
+	_ = q.Enqueue(nil)
+}
+
+// Handlers of an async queue receive injected dequeue errors.
+func TestAsyncErrors(t *testing.T) {
+	q := faultq.New(queue.NewMemoryQueue(), &faultq.Config{
+		Seed:             1,
+		DequeueErrorRate: 0.5,
+	})
+	const n = 10
+	var (
+		datas = make(chan []byte, n)
+		errs  = make(chan error, 100)
+	)
+	handler := func(data []byte, err error) {
+		if err != nil {
+			errs <- err
+			return
+		}
+		datas <- data
+	}
+	aq, err := queue.NewAsyncQueue(q, handler, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aq.Close()
+	for i := 0; i < n; i++ {
+		if err = aq.Enqueue([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for i := 0; i < n; i++ {
+		select {
+		case <-datas:
+		case <-timer.C:
+			t.Fatalf("only %d of %d handled", i, n)
+		}
+	}
+	select {
+	case err := <-errs:
+		if err != faultq.ErrInjected {
+			t.Fatalf("want ErrInjected, have %v", err)
+		}
+	default:
+		t.Fatal("handler received no errors")
+	}
+}
+
+// The wrapper reports its length only when the inner queue does.
+func TestLen(t *testing.T) {
+	q := faultq.New(queue.NewMemoryQueue(), nil)
+	if err := q.Enqueue(nil); err != nil {
+		t.Fatal(err)
+	}
+	l, ok := q.(queue.Lener)
+	if !ok {
+		t.Fatal("queue.Lener not implemented")
+	}
+	if n, err := l.Len(); err != nil || n != 1 {
+		t.Fatalf("want length 1, have %d (%v)", n, err)
+	}
+	// Hide the Len method of the inner queue.
+	inner := struct{ queue.Queue }{queue.NewMemoryQueue()}
+	if _, ok = faultq.New(inner, nil).(queue.Lener); ok {
+		t.Fatal("queue.Lener implemented without inner queue.Lener")
+	}
+}
@@ -3,7 +3,6 @@ package httpq
 
 import (
 	"bytes"
-	"encoding/gob"
 	"errors"
 	"io"
 	"net/http"
@@ -36,6 +35,9 @@ type Config struct {
 	DefaultMaxRetries int
 	Client            *http.Client
 	Errors            chan<- error
+
+	// Middleware wrapping the handler which sends requests.
+	Middleware []queue.Middleware
 }
 
 type request struct {
@@ -80,7 +82,11 @@ func New(q queue.Queue, pass []byte, cfg *Config) (HTTPQueue, error) {
 		maxRetries: cfg.DefaultMaxRetries,
 		errors:     cfg.Errors,
 	}
-	async, err := queue.NewAsyncQueue(q, httpq.handler, cfg.Workers)
+	async, err := queue.NewAsyncQueueConfig(q, httpq.handler,
+		&queue.AsyncConfig{
+			Workers:    cfg.Workers,
+			Middleware: cfg.Middleware,
+		})
 	if err != nil {
 		return nil, err
 	}
@@ -96,7 +102,7 @@ func (q *httpQueue) Enqueue(req *Request) error {
 }
 
 func (q *httpQueue) enqueue(req *request) error {
-	data, err := q.encode(req)
+	data, err := encode(q.pass, req)
 	if err != nil {
 		return err
 	}
@@ -107,27 +113,33 @@ func (q *httpQueue) Close() error {
 	return q.q.Close()
 }
 
+// Decode a request stored in the inner queue by an HTTP queue, along with the
+// number of retries it has left. Pass must be the password given to New.
+func Decode(data, pass []byte) (*Request, int, error) {
+	var req request
+	if err := decode(data, pass, &req); err != nil {
+		return nil, 0, err
+	}
+	return req.Request, req.Retries, nil
+}
+
 // TODO: benchmark encoder/decoder pools vs. only buffer pools vs no pools.
-func (q *httpQueue) encode(v interface{}) ([]byte, error) {
-	if q.pass == nil {
-		var b bytes.Buffer
-		if err := gob.NewEncoder(&b).Encode(v); err != nil {
-			return nil, err
-		}
-		return b.Bytes(), nil
+func encode(pass []byte, v interface{}) ([]byte, error) {
+	if pass == nil {
+		return queue.GobCodec.Marshal(v)
 	}
-	data, _, err := enc.Encrypt(q.pass, v)
+	data, _, err := enc.Encrypt(pass, v)
 	if err != nil {
 		return nil, err
 	}
 	return data, nil
 }
 
-func (q *httpQueue) decode(data []byte, v interface{}) error {
-	if q.pass == nil {
-		return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+func decode(data, pass []byte, v interface{}) error {
+	if pass == nil {
+		return queue.GobCodec.Unmarshal(data, v)
 	}
-	return enc.Decrypt(data, q.pass, v)
+	return enc.Decrypt(data, pass, v)
 }
 
 func (q *httpQueue) handler(data []byte, err error) {
@@ -136,7 +148,7 @@ func (q *httpQueue) handler(data []byte, err error) {
 		return
 	}
 	var req request
-	if err = q.decode(data, &req); err != nil {
+	if err = decode(data, q.pass, &req); err != nil {
 		q.log(err)
 		return
 	}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -23,6 +24,7 @@ func TestSimple(t *testing.T) {
 	defer ch.Close()
 	errors := make(chan error, 1)
 	defer close(errors)
+	var timed int32
 	cfg := &httpq.Config{
 		Workers:           2,
 		DefaultMaxRetries: 0,
@@ -30,6 +32,11 @@ func TestSimple(t *testing.T) {
 			Timeout: 50 * time.Millisecond,
 		},
 		Errors: errors,
+		Middleware: []queue.Middleware{
+			queue.Timing(func(time.Duration) {
+				atomic.AddInt32(&timed, 1)
+			}),
+		},
 	}
 	q, err := httpq.New(queue.NewMemoryQueue(), nil, cfg)
 	if err != nil {
@@ -63,6 +70,9 @@ func TestSimple(t *testing.T) {
 	if err = q.Close(); err != nil {
 		t.Fatal(err)
 	}
+	if atomic.LoadInt32(&timed) != 1 {
+		t.Fatal("middleware not applied")
+	}
 }
 
 func cmpReqs(r1 *httpq.Request, r2 *http.Request) error {
@@ -208,3 +218,58 @@ func TestRace(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// recorder is a queue which only records enqueued data.
+type recorder struct {
+	datas chan []byte
+}
+
+func (r *recorder) Enqueue(data []byte) error {
+	r.datas <- data
+	return nil
+}
+
+func (r *recorder) Dequeue() ([]byte, error) {
+	return nil, queue.ErrEmpty
+}
+
+func (r *recorder) Close() error {
+	return nil
+}
+
+func TestDecode(t *testing.T) {
+	for _, pass := range [][]byte{nil, []byte("password")} {
+		r := &recorder{datas: make(chan []byte, 1)}
+		q, err := httpq.New(r, pass, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &httpq.Request{
+			Body:   []byte("body"),
+			Method: http.MethodPost,
+			URL: &url.URL{
+				Scheme: "http",
+				Host:   "198.51.100.5", // TEST-NET-2
+				Path:   "/xyz",
+			},
+		}
+		if err = q.Enqueue(req); err != nil {
+			t.Fatal(err)
+		}
+		decoded, retries, err := httpq.Decode(<-r.datas, pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retries != 3 {
+			t.Fatalf("want 3 retries, have %d", retries)
+		}
+		if !bytes.Equal(req.Body, decoded.Body) ||
+			req.Method != decoded.Method ||
+			req.URL.String() != decoded.URL.String() {
+			t.Fatalf("want %v, have %v", req, decoded)
+		}
+		if err = q.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
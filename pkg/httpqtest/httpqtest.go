@@ -0,0 +1,249 @@
+// Package httpqtest provides a scriptable HTTP server for testing code which
+// sends requests through httpq.
+package httpqtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Response describes how the server responds to a request.
+type Response struct {
+	// Status code, 200 if zero.
+	Status int
+
+	// Header added to the response.
+	Header http.Header
+
+	// Body of the response.
+	Body []byte
+
+	// Delay before responding.
+	Delay time.Duration
+
+	// Reset the connection instead of responding.
+	Reset bool
+
+	// Delay between each byte of the body.
+	BodyInterval time.Duration
+}
+
+// Request is a request received by the server.
+type Request struct {
+	Method string
+	URL    *url.URL
+	Header http.Header
+	Body   []byte
+
+	// When the request was received, and how long the server took to
+	// respond to it.
+	Received time.Time
+	Duration time.Duration
+}
+
+// Server responds to requests according to per-path scripts and records them.
+type Server struct {
+	// URL of the server, such as http://127.0.0.1:1234.
+	URL string
+
+	ts *httptest.Server
+
+	mu       sync.Mutex
+	scripts  map[string][]Response
+	def      Response
+	reqs     []*Request
+	received chan struct{}
+}
+
+// NewServer starts a server on a loopback address, which responds with status
+// 200 to all requests until scripted otherwise.
+func NewServer() *Server {
+	s := &Server{
+		scripts:  make(map[string][]Response),
+		received: make(chan struct{}),
+	}
+	s.ts = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.ts.URL
+	return s
+}
+
+// Script the responses to successive requests for path. Once all responses
+// are used, the last one is repeated. Replaces any earlier script for path.
+func (s *Server) Script(path string, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(responses) == 0 {
+		delete(s.scripts, path)
+		return
+	}
+	s.scripts[path] = responses
+}
+
+// SetDefault sets the response to requests for paths without a script.
+func (s *Server) SetDefault(resp Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.def = resp
+}
+
+// Requests returns the requests received so far, in order. Requests are
+// recorded once the server has responded to them.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := make([]Request, len(s.reqs))
+	for i, r := range s.reqs {
+		reqs[i] = *r
+	}
+	return reqs
+}
+
+// Count returns the number of requests received for path.
+func (s *Server) Count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count(path)
+}
+
+func (s *Server) count(path string) int {
+	n := 0
+	for _, r := range s.reqs {
+		if r.URL.Path == path {
+			n++
+		}
+	}
+	return n
+}
+
+// WaitCount waits until at least n requests for path are received, returning
+// an error if that takes longer than timeout.
+func (s *Server) WaitCount(path string, n int, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		have := s.count(path)
+		received := s.received
+		s.mu.Unlock()
+		if have >= n {
+			return nil
+		}
+		select {
+		case <-received:
+		case <-timer.C:
+			return fmt.Errorf("httpqtest: %s: want %d requests, have %d",
+				path, n, have)
+		}
+	}
+}
+
+// ExpectCount fails t unless exactly n requests for path are received within
+// timeout, and no more arrive within settle afterwards.
+func (s *Server) ExpectCount(t testing.TB, path string, n int, timeout,
+	settle time.Duration) {
+	t.Helper()
+	if err := s.WaitCount(path, n, timeout); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(settle)
+	if have := s.Count(path); have != n {
+		t.Fatalf("httpqtest: %s: want %d requests, have %d", path, n,
+			have)
+	}
+}
+
+// Close the server, blocking until all requests have finished.
+func (s *Server) Close() {
+	s.ts.Close()
+}
+
+// Take the next response for path from its script.
+func (s *Server) next(path string) Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	script, ok := s.scripts[path]
+	if !ok {
+		return s.def
+	}
+	resp := script[0]
+	if len(script) > 1 {
+		s.scripts[path] = script[1:]
+	}
+	return resp
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	req := &Request{
+		Method:   r.Method,
+		URL:      r.URL,
+		Header:   r.Header,
+		Received: time.Now(),
+	}
+	req.Body, _ = ioutil.ReadAll(r.Body)
+	defer func() {
+		req.Duration = time.Since(req.Received)
+		s.mu.Lock()
+		s.reqs = append(s.reqs, req)
+		close(s.received)
+		s.received = make(chan struct{})
+		s.mu.Unlock()
+	}()
+
+	resp := s.next(r.URL.Path)
+	time.Sleep(resp.Delay)
+	if resp.Reset {
+		reset(w)
+		return
+	}
+	for key, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(key, v)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if resp.BodyInterval <= 0 {
+		_, _ = w.Write(resp.Body)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	for i := range resp.Body {
+		if i > 0 {
+			time.Sleep(resp.BodyInterval)
+		}
+		if _, err := w.Write(resp.Body[i : i+1]); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// Close the connection abruptly, so that the client sees a reset.
+func reset(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	_ = conn.Close()
+}
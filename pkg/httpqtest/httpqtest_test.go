@@ -0,0 +1,134 @@
+package httpqtest_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/pkg/httpq"
+	"github.com/esote/queue/pkg/httpqtest"
+)
+
+func TestScript(t *testing.T) {
+	s := httpqtest.NewServer()
+	defer s.Close()
+	s.Script("/a",
+		httpqtest.Response{Status: http.StatusTeapot},
+		httpqtest.Response{
+			Header: http.Header{"X-Test": {"yes"}},
+			Body:   []byte("ok"),
+		})
+	want := []struct {
+		status int
+		body   string
+	}{
+		{http.StatusTeapot, ""},
+		{http.StatusOK, "ok"},
+		{http.StatusOK, "ok"},
+	}
+	for i, w := range want {
+		resp, err := http.Post(s.URL+"/a", "text/plain",
+			strings.NewReader("req"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != w.status || string(body) != w.body {
+			t.Fatalf("response %d: want %d %q, have %d %q", i,
+				w.status, w.body, resp.StatusCode, body)
+		}
+		if i > 0 && resp.Header.Get("X-Test") != "yes" {
+			t.Fatalf("response %d: missing header", i)
+		}
+	}
+	reqs := s.Requests()
+	if len(reqs) != 3 || s.Count("/a") != 3 || s.Count("/b") != 0 {
+		t.Fatalf("unexpected requests %v", reqs)
+	}
+	if reqs[0].Method != http.MethodPost || string(reqs[0].Body) != "req" {
+		t.Fatalf("unexpected request %v", reqs[0])
+	}
+}
+
+func TestFailures(t *testing.T) {
+	s := httpqtest.NewServer()
+	defer s.Close()
+	s.Script("/reset", httpqtest.Response{Reset: true})
+	s.Script("/slow", httpqtest.Response{
+		Delay:        20 * time.Millisecond,
+		Body:         []byte("abc"),
+		BodyInterval: 10 * time.Millisecond,
+	})
+	if resp, err := http.Get(s.URL + "/reset"); err == nil {
+		_ = resp.Body.Close()
+		t.Fatal("connection not reset")
+	}
+	start := time.Now()
+	resp, err := http.Get(s.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil || string(body) != "abc" {
+		t.Fatalf("unexpected body %q (%v)", body, err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("slow response took %s", elapsed)
+	}
+	reqs := s.Requests()
+	if len(reqs) != 2 || reqs[1].Duration < 40*time.Millisecond {
+		t.Fatalf("unexpected requests %v", reqs)
+	}
+}
+
+// An HTTP queue retries until the server succeeds.
+func TestHTTPQueue(t *testing.T) {
+	s := httpqtest.NewServer()
+	defer s.Close()
+	s.Script("/hook",
+		httpqtest.Response{Status: http.StatusInternalServerError},
+		httpqtest.Response{Reset: true},
+		httpqtest.Response{Status: http.StatusServiceUnavailable},
+		httpqtest.Response{Status: http.StatusOK})
+	errors := make(chan error, 10)
+	cfg := &httpq.Config{
+		Workers:           2,
+		DefaultMaxRetries: 5,
+		Client: &http.Client{
+			Timeout: time.Second,
+		},
+		Errors: errors,
+	}
+	q, err := httpq.New(queue.NewMemoryQueue(), nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	u, err := url.Parse(s.URL + "/hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &httpq.Request{
+		Method: http.MethodPost,
+		URL:    u,
+	}
+	if err = q.Enqueue(req); err != nil {
+		t.Fatal(err)
+	}
+	// The reset is reported as an error and not retried by httpq.
+	s.ExpectCount(t, "/hook", 2, time.Second, 50*time.Millisecond)
+	select {
+	case <-errors:
+	default:
+		t.Fatal("reset not reported")
+	}
+}
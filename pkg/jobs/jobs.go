@@ -0,0 +1,181 @@
+// Package jobs runs named jobs with typed arguments on top of
+// queue.AsyncQueue. Job types are registered by name, each item in the queue
+// names its job type along with encoded arguments, and a dispatcher decodes the
+// arguments and calls the registered function.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/esote/queue"
+)
+
+// ErrUnknownJob is matched by errors for items naming an unregistered job type.
+var ErrUnknownJob = errors.New("jobs: unknown job")
+
+// UnknownJobError is returned when dispatching an item whose job type is not
+// registered.
+type UnknownJobError struct {
+	Name string
+}
+
+func (e *UnknownJobError) Error() string {
+	return fmt.Sprintf("jobs: unknown job %q", e.Name)
+}
+
+// Is reports whether target is ErrUnknownJob.
+func (e *UnknownJobError) Is(target error) bool {
+	return target == ErrUnknownJob
+}
+
+// Func runs a job with its arguments. Jobs returning an error are retried as
+// configured for the queue.
+type Func[T any] func(ctx context.Context, args T) error
+
+// Stored form of a job.
+type envelope struct {
+	Name string
+	Args []byte
+}
+
+// Registry maps job type names to functions.
+type Registry struct {
+	codec queue.Codec
+
+	mu   sync.RWMutex
+	jobs map[string]func(ctx context.Context, args []byte) error
+}
+
+// NewRegistry creates a registry with no job types, encoding jobs with codec.
+// A nil codec means queue.GobCodec.
+func NewRegistry(codec queue.Codec) *Registry {
+	if codec == nil {
+		codec = queue.GobCodec
+	}
+	return &Registry{
+		codec: codec,
+		jobs:  make(map[string]func(context.Context, []byte) error),
+	}
+}
+
+// Register fn as the job type name, whose arguments are of type T.
+func Register[T any](r *Registry, name string, fn Func[T]) error {
+	if name == "" {
+		return errors.New("jobs: job name is empty")
+	}
+	if fn == nil {
+		return errors.New("jobs: job func is nil")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.jobs[name]; ok {
+		return fmt.Errorf("jobs: job %q already registered", name)
+	}
+	r.jobs[name] = func(ctx context.Context, data []byte) error {
+		var args T
+		if err := r.codec.Unmarshal(data, &args); err != nil {
+			return &queue.DecodeError{Data: data, Err: err}
+		}
+		return fn(ctx, args)
+	}
+	return nil
+}
+
+// Encode a job of type name with args. The job type need not be registered
+// with r, so that producers do not need the job functions.
+func (r *Registry) Encode(name string, args interface{}) ([]byte, error) {
+	data, err := r.codec.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	return r.codec.Marshal(envelope{
+		Name: name,
+		Args: data,
+	})
+}
+
+// Dispatch an encoded job to the function registered for its type. Returns an
+// *UnknownJobError if the type is not registered, and a *queue.DecodeError if
+// the job or its arguments cannot be decoded.
+func (r *Registry) Dispatch(ctx context.Context, data []byte) error {
+	var env envelope
+	if err := r.codec.Unmarshal(data, &env); err != nil {
+		return &queue.DecodeError{Data: data, Err: err}
+	}
+	r.mu.RLock()
+	fn, ok := r.jobs[env.Name]
+	r.mu.RUnlock()
+	if !ok {
+		return &UnknownJobError{Name: env.Name}
+	}
+	return fn(ctx, env.Args)
+}
+
+// Queue runs jobs asynchronously. The methods of the embedded AsyncQueue other
+// than Enqueue may be used as usual.
+type Queue struct {
+	queue.AsyncQueue
+	r *Registry
+}
+
+// New creates an async queue running jobs stored in q through the functions
+// registered with r, configured by cfg as in queue.NewContextQueue. Jobs of
+// unknown type or which cannot be decoded are not retried; their errors are
+// sent to cfg.Errors like other errors. Such jobs are added to the dead letter
+// queue of cfg.Panic when there is one, whatever its Action, and are otherwise
+// dropped, so a dead letter queue should be given when producers may know of
+// job types which consumers do not. Closing the job queue does NOT close the
+// inner queue.
+func New(q queue.Queue, r *Registry, cfg *queue.AsyncConfig) (*Queue, error) {
+	if r == nil {
+		return nil, errors.New("jobs: registry is nil")
+	}
+	var (
+		errs chan<- error
+		dead queue.Queue
+	)
+	if cfg != nil {
+		errs = cfg.Errors
+		if cfg.Panic != nil {
+			dead = cfg.Panic.DeadLetter
+		}
+	}
+	handler := func(ctx context.Context, data []byte, attempt int) error {
+		err := r.Dispatch(ctx, data)
+		var derr *queue.DecodeError
+		if errors.Is(err, ErrUnknownJob) || errors.As(err, &derr) {
+			if dead != nil {
+				if err2 := dead.Enqueue(data); err2 != nil {
+					// Retry rather than drop the job.
+					return err2
+				}
+			}
+			select {
+			case errs <- err:
+			default:
+			}
+			return nil
+		}
+		return err
+	}
+	aq, err := queue.NewContextQueue(q, handler, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Queue{
+		AsyncQueue: aq,
+		r:          r,
+	}, nil
+}
+
+// Enqueue a job of type name with args. Safe for concurrent use.
+func (q *Queue) Enqueue(name string, args interface{}) error {
+	data, err := q.r.Encode(name, args)
+	if err != nil {
+		return err
+	}
+	return q.AsyncQueue.Enqueue(data)
+}
@@ -0,0 +1,166 @@
+package jobs_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/pkg/jobs"
+)
+
+type email struct {
+	To      string
+	Subject string
+}
+
+func TestQueue(t *testing.T) {
+	for name, codec := range map[string]queue.Codec{
+		"gob":  nil,
+		"json": queue.JSONCodec,
+	} {
+		emails := make(chan email, 1)
+		sums := make(chan int, 1)
+		r := jobs.NewRegistry(codec)
+		err := jobs.Register(r, "email", func(ctx context.Context,
+			args email) error {
+			emails <- args
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		failed := false
+		err = jobs.Register(r, "sum", func(ctx context.Context,
+			args []int) error {
+			// Fail once to check that jobs are retried.
+			if !failed {
+				failed = true
+				return errors.New("fail")
+			}
+			sum := 0
+			for _, v := range args {
+				sum += v
+			}
+			sums <- sum
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := make(chan error, 1)
+		cfg := &queue.AsyncConfig{
+			Workers: 1,
+			Retry: &queue.RetryConfig{
+				MaxAttempts: 2,
+				Backoff:     time.Millisecond,
+			},
+			Errors: errs,
+		}
+		q, err := jobs.New(queue.NewMemoryQueue(), r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := email{To: "a@example.com", Subject: "hi"}
+		if err = q.Enqueue("email", want); err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Enqueue("sum", []int{1, 2, 3}); err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Enqueue("missing", struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+		if have := <-emails; have != want {
+			t.Fatalf("%s: want %v, have %v", name, want, have)
+		}
+		if have := <-sums; have != 6 {
+			t.Fatalf("%s: want sum 6, have %d", name, have)
+		}
+		err = <-errs
+		var unknown *jobs.UnknownJobError
+		if !errors.As(err, &unknown) || unknown.Name != "missing" ||
+			!errors.Is(err, jobs.ErrUnknownJob) {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		if err = q.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		// Unknown jobs are not retried.
+		if stats := q.Stats(); stats.Failed != 1 {
+			t.Fatalf("%s: unexpected stats %+v", name, stats)
+		}
+		if err = q.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Jobs of unknown type are kept in the dead letter queue.
+func TestDeadLetter(t *testing.T) {
+	producer := jobs.NewRegistry(nil)
+	consumer := jobs.NewRegistry(nil)
+	errs := make(chan error, 1)
+	dead := queue.NewMemoryQueue()
+	cfg := &queue.AsyncConfig{
+		Workers: 1,
+		Errors:  errs,
+		Panic: &queue.PanicConfig{
+			DeadLetter: dead,
+		},
+	}
+	q, err := jobs.New(queue.NewMemoryQueue(), consumer, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	want, err := producer.Encode("new", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enqueued by a producer knowing of more job types.
+	if err = q.AsyncQueue.Enqueue(want); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errs; !errors.Is(err, jobs.ErrUnknownJob) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	have, err := dead.Dequeue()
+	if err != nil || string(have) != string(want) {
+		t.Fatalf("job not dead lettered: %q (%v)", have, err)
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	r := jobs.NewRegistry(queue.JSONCodec)
+	err := jobs.Register(r, "n", func(ctx context.Context, args int) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = jobs.Register(r, "n", func(ctx context.Context, args int) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("job registered twice")
+	}
+	data, err := r.Encode("n", "not a number")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var derr *queue.DecodeError
+	if err = r.Dispatch(context.Background(), data); !errors.As(err, &derr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err = r.Dispatch(context.Background(), []byte("{")); !errors.As(err, &derr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if data, err = r.Encode("n", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Dispatch(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+}
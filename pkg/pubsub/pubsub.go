@@ -0,0 +1,221 @@
+// Package pubsub broadcasts messages to every subscriber of a topic, on top of
+// queue.AsyncQueue.
+//
+// Topics are made of tokens separated by dots, such as "orders.eu.created".
+// Subscription patterns may use the wildcard "*" to match exactly one token and
+// ">" as the last token to match one or more remaining tokens, so
+// "orders.*.created" and "orders.>" both match the topic above.
+package pubsub
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/esote/queue"
+)
+
+// Handler operates on messages received by a subscription. Err comes from the
+// subscription queue's dequeue operation, or from decoding the stored message.
+type Handler func(topic string, data []byte, err error)
+
+// Broker delivers published messages to subscriptions.
+type Broker struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// Subscription receives every message published to a topic matching its
+// pattern.
+type Subscription struct {
+	b       *Broker
+	pattern string
+	tokens  []string
+	q       queue.AsyncQueue
+	handler Handler
+	once    sync.Once
+}
+
+// ErrClosed is returned when using a closed broker.
+var ErrClosed = errors.New("pubsub: broker is closed")
+
+// New creates a broker with no subscriptions.
+func New() *Broker {
+	return &Broker{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe to topics matching pattern. Messages are stored in q, which belongs
+// to the subscription alone, and processed by handler with a pool of workers.
+// Messages left in q by an earlier subscription are processed as well, so a
+// durable q lets a subscriber resume after a restart. Closing the subscription
+// does NOT close q.
+func (b *Broker) Subscribe(pattern string, q queue.Queue, handler Handler,
+	workers int) (*Subscription, error) {
+	tokens, err := split(pattern, true)
+	if err != nil {
+		return nil, err
+	}
+	if handler == nil {
+		return nil, errors.New("pubsub: handler is nil")
+	}
+	s := &Subscription{
+		b:       b,
+		pattern: pattern,
+		tokens:  tokens,
+		handler: handler,
+	}
+	s.q, err = queue.NewAsyncQueue(q, s.handle, workers)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		_ = s.q.Close()
+		return nil, ErrClosed
+	}
+	b.subs[s] = struct{}{}
+	return s, nil
+}
+
+// Publish data to all subscriptions matching topic. Data is given to every
+// matching subscription even if some of them fail, in which case the first
+// error is returned.
+func (b *Broker) Publish(topic string, data []byte) error {
+	tokens, err := split(topic, false)
+	if err != nil {
+		return err
+	}
+	msg := encode(topic, data)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrClosed
+	}
+	for s := range b.subs {
+		if !match(s.tokens, tokens) {
+			continue
+		}
+		if err2 := s.q.Enqueue(msg); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Close the broker and all of its subscriptions.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	b.closed = true
+	subs := b.subs
+	b.subs = nil
+	b.mu.Unlock()
+	var err error
+	for s := range subs {
+		if err2 := s.close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Pattern returns the topic pattern of the subscription.
+func (s *Subscription) Pattern() string {
+	return s.pattern
+}
+
+// Close the subscription, removing it from the broker. Messages published
+// afterwards are not stored in the subscription queue.
+func (s *Subscription) Close() error {
+	s.b.mu.Lock()
+	delete(s.b.subs, s)
+	s.b.mu.Unlock()
+	return s.close()
+}
+
+func (s *Subscription) close() error {
+	err := errors.New("pubsub: close on closed subscription")
+	s.once.Do(func() {
+		err = s.q.Close()
+	})
+	return err
+}
+
+func (s *Subscription) handle(data []byte, err error) {
+	if err != nil {
+		s.handler("", nil, err)
+		return
+	}
+	topic, data, err := decode(data)
+	s.handler(topic, data, err)
+}
+
+// Match reports whether topic matches pattern.
+func Match(pattern, topic string) bool {
+	p, err := split(pattern, true)
+	if err != nil {
+		return false
+	}
+	t, err := split(topic, false)
+	if err != nil {
+		return false
+	}
+	return match(p, t)
+}
+
+func match(pattern, topic []string) bool {
+	for i, p := range pattern {
+		switch {
+		case p == ">":
+			return len(topic) > i
+		case i >= len(topic):
+			return false
+		case p != "*" && p != topic[i]:
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
+
+// Split topic or pattern into tokens.
+func split(s string, pattern bool) ([]string, error) {
+	tokens := strings.Split(s, ".")
+	for i, t := range tokens {
+		switch {
+		case t == "":
+			return nil, fmt.Errorf("pubsub: %q contains an empty token", s)
+		case !pattern && (t == "*" || t == ">"):
+			return nil, fmt.Errorf("pubsub: topic %q contains a wildcard", s)
+		case t == ">" && i != len(tokens)-1:
+			return nil, fmt.Errorf("pubsub: pattern %q has tokens after >", s)
+		}
+	}
+	return tokens, nil
+}
+
+// Messages are stored as the topic length, the topic, then the data.
+func encode(topic string, data []byte) []byte {
+	msg := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+
+		len(topic)+len(data))
+	n := binary.PutUvarint(msg, uint64(len(topic)))
+	msg = append(msg[:n], topic...)
+	return append(msg, data...)
+}
+
+func decode(msg []byte) (string, []byte, error) {
+	n, i := binary.Uvarint(msg)
+	if i <= 0 || uint64(len(msg)-i) < n {
+		return "", nil, errors.New("pubsub: malformed message")
+	}
+	msg = msg[i:]
+	return string(msg[:n]), msg[n:], nil
+}
@@ -0,0 +1,174 @@
+package pubsub_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/internal/tmpdb"
+	"github.com/esote/queue/pkg/pubsub"
+)
+
+func TestMain(m *testing.M) {
+	ret := m.Run()
+	tmpdb.Clean()
+	os.Exit(ret)
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"a.b.c", "a.b.c", true},
+		{"a.b.c", "a.b", false},
+		{"a.b", "a.b.c", false},
+		{"a.*.c", "a.b.c", true},
+		{"a.*.c", "a.b.d", false},
+		{"a.*", "a.b.c", false},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a.b", true},
+		{"a.>", "a", false},
+		{">", "a", true},
+		{"*.*", "a.b", true},
+		{"a.>.c", "a.b.c", false},
+		{"a..b", "a..b", false},
+		{"a.*", "a.*", false},
+	}
+	for _, test := range tests {
+		if have := pubsub.Match(test.pattern, test.topic); have != test.want {
+			t.Errorf("Match(%q, %q): want %t, have %t", test.pattern,
+				test.topic, test.want, have)
+		}
+	}
+}
+
+type message struct {
+	topic string
+	data  string
+}
+
+func subscribe(t *testing.T, b *pubsub.Broker, pattern string,
+	q queue.Queue) (*pubsub.Subscription, <-chan message) {
+	ch := make(chan message, 10)
+	handler := func(topic string, data []byte, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ch <- message{topic, string(data)}
+	}
+	s, err := b.Subscribe(pattern, q, handler, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, ch
+}
+
+func receive(t *testing.T, ch <-chan message, want message) {
+	timer := time.NewTimer(100 * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case have := <-ch:
+		if have != want {
+			t.Fatalf("want %v, have %v", want, have)
+		}
+	case <-timer.C:
+		t.Fatalf("%v not received", want)
+	}
+}
+
+func none(t *testing.T, ch <-chan message) {
+	timer := time.NewTimer(20 * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case have := <-ch:
+		t.Fatalf("unexpected %v", have)
+	case <-timer.C:
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	file, err := tmpdb.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite3, err := queue.NewSqlite3Queue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite3.Close()
+	b := pubsub.New()
+	_, all := subscribe(t, b, "orders.>", sqlite3)
+	_, created := subscribe(t, b, "orders.*.created", queue.NewMemoryQueue())
+	eu, euCh := subscribe(t, b, "orders.eu.*", queue.NewMemoryQueue())
+
+	if err = b.Publish("orders.eu.created", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	want := message{"orders.eu.created", "1"}
+	receive(t, all, want)
+	receive(t, created, want)
+	receive(t, euCh, want)
+
+	if err = b.Publish("orders.us.deleted", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, all, message{"orders.us.deleted", "2"})
+	none(t, created)
+	none(t, euCh)
+
+	// Remove subscription at runtime.
+	if err = eu.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Publish("orders.eu.deleted", nil); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, all, message{"orders.eu.deleted", ""})
+	none(t, euCh)
+
+	if err = b.Publish("orders.*", nil); err == nil {
+		t.Fatal("published to wildcard topic")
+	}
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Publish("orders.eu.created", nil); err != pubsub.ErrClosed {
+		t.Fatalf("want ErrClosed, have %v", err)
+	}
+}
+
+func TestDurable(t *testing.T) {
+	q := queue.NewMemoryQueue()
+	b := pubsub.New()
+	s, _ := subscribe(t, b, "a", q)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Message stored in the queue while nobody is processing it.
+	b2 := pubsub.New()
+	s2, ch := subscribe(t, b2, "a", &noDequeue{q})
+	if err := b2.Publish("a", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	none(t, ch)
+	// A new subscription on the same queue picks up the stored message.
+	_, ch = subscribe(t, b, "a", q)
+	receive(t, ch, message{"a", "x"})
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type noDequeue struct {
+	queue.Queue
+}
+
+func (q *noDequeue) Dequeue() ([]byte, error) {
+	return nil, queue.ErrEmpty
+}
@@ -0,0 +1,266 @@
+// Package queuetest checks that queue.Queue implementations behave like the
+// queues of package queue, so that they can be used with the rest of the
+// module.
+package queuetest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+)
+
+// Factory creates a new, empty queue.
+type Factory func() (queue.Queue, error)
+
+// Run the standard tests as subtests of t, each on its own queue from f.
+func Run(t *testing.T, f Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, q queue.Queue)
+
+		// Whether the test closes the queue itself.
+		closes bool
+	}{
+		{"FIFO", testFIFO, false},
+		{"Empty", testEmpty, false},
+		{"EmptyData", testEmptyData, false},
+		{"Len", testLen, false},
+		{"Concurrent", testConcurrent, false},
+		{"Large", testLarge, false},
+		{"Close", testClose, true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			q, err := f()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.closes {
+				defer q.Close()
+			}
+			test.test(t, q)
+		})
+	}
+}
+
+func enqueue(t *testing.T, q queue.Queue, data []byte) {
+	t.Helper()
+	if err := q.Enqueue(data); err != nil {
+		t.Fatalf("enqueue: %s", err)
+	}
+}
+
+func dequeue(t *testing.T, q queue.Queue, want []byte) {
+	t.Helper()
+	data, err := q.Dequeue()
+	if err != nil {
+		t.Fatalf("dequeue: %s", err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("dequeue: want %q, have %q", want, data)
+	}
+}
+
+func empty(t *testing.T, q queue.Queue) {
+	t.Helper()
+	if data, err := q.Dequeue(); err != queue.ErrEmpty {
+		t.Fatalf("dequeue: want ErrEmpty, have %q, %v", data, err)
+	}
+}
+
+func testFIFO(t *testing.T, q queue.Queue) {
+	const n = 10
+	for i := byte(0); i < n; i++ {
+		enqueue(t, q, []byte{i})
+	}
+	for i := byte(0); i < n/2; i++ {
+		dequeue(t, q, []byte{i})
+	}
+	// Interleaved enqueues go behind existing data.
+	enqueue(t, q, []byte{n})
+	for i := byte(n / 2); i <= n; i++ {
+		dequeue(t, q, []byte{i})
+	}
+	empty(t, q)
+}
+
+func testEmpty(t *testing.T, q queue.Queue) {
+	empty(t, q)
+	empty(t, q)
+	enqueue(t, q, []byte("x"))
+	dequeue(t, q, []byte("x"))
+	empty(t, q)
+}
+
+func testEmptyData(t *testing.T, q queue.Queue) {
+	enqueue(t, q, nil)
+	enqueue(t, q, []byte{})
+	dequeue(t, q, nil)
+	dequeue(t, q, nil)
+	empty(t, q)
+}
+
+func testLen(t *testing.T, q queue.Queue) {
+	l, ok := q.(queue.Lener)
+	if !ok {
+		t.Skip("queue does not implement queue.Lener")
+	}
+	check := func(want int) {
+		t.Helper()
+		n, err := l.Len()
+		if err != nil {
+			t.Fatalf("len: %s", err)
+		}
+		if n != want {
+			t.Fatalf("len: want %d, have %d", want, n)
+		}
+	}
+	check(0)
+	enqueue(t, q, nil)
+	enqueue(t, q, nil)
+	check(2)
+	dequeue(t, q, nil)
+	check(1)
+	dequeue(t, q, nil)
+	check(0)
+}
+
+func testConcurrent(t *testing.T, q queue.Queue) {
+	const (
+		producers = 4
+		consumers = 4
+		n         = 100
+	)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[uint32]bool)
+		errs = make(chan error, producers+consumers)
+	)
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				var data [4]byte
+				binary.BigEndian.PutUint32(data[:], uint32(p*n+i))
+				if err := q.Enqueue(data[:]); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(p)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for c := 0; c < consumers; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				mu.Lock()
+				done := len(seen) == producers*n
+				mu.Unlock()
+				if done {
+					return
+				}
+				data, err := q.Dequeue()
+				if err == queue.ErrEmpty {
+					time.Sleep(time.Millisecond)
+					continue
+				} else if err != nil {
+					errs <- err
+					return
+				}
+				if len(data) != 4 {
+					errs <- fmt.Errorf("corrupt data %q", data)
+					return
+				}
+				v := binary.BigEndian.Uint32(data)
+				mu.Lock()
+				dup := seen[v]
+				seen[v] = true
+				mu.Unlock()
+				if dup {
+					errs <- fmt.Errorf("%d dequeued twice", v)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if len(seen) != producers*n {
+		t.Fatalf("want %d items dequeued, have %d", producers*n,
+			len(seen))
+	}
+	empty(t, q)
+}
+
+func testLarge(t *testing.T, q queue.Queue) {
+	data := make([]byte, 4<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	enqueue(t, q, data)
+	enqueue(t, q, []byte("small"))
+	dequeue(t, q, data)
+	dequeue(t, q, []byte("small"))
+}
+
+// A closed queue may stay usable, as memory queues do, or fail with errors, but
+// its methods must neither panic, block nor return corrupt data. Closing again
+// may return an error.
+func testClose(t *testing.T, q queue.Queue) {
+	// Remaining data must not prevent closing.
+	enqueue(t, q, []byte("x"))
+	if err := q.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	ops := []struct {
+		name string
+		op   func()
+	}{
+		{"enqueue", func() {
+			_ = q.Enqueue([]byte("y"))
+		}},
+		{"dequeue", func() {
+			// Data is either kept or unavailable.
+			data, err := q.Dequeue()
+			if err == nil && string(data) != "x" && string(data) != "y" {
+				t.Errorf("dequeue after close: unexpected data %q",
+					data)
+			}
+		}},
+		{"close", func() {
+			_ = q.Close()
+		}},
+	}
+	for _, op := range ops {
+		done := make(chan interface{}, 1)
+		go func(op func()) {
+			defer func() {
+				done <- recover()
+			}()
+			op()
+		}(op.op)
+		timer := time.NewTimer(10 * time.Second)
+		select {
+		case v := <-done:
+			if v != nil {
+				t.Fatalf("%s after close: panic: %v", op.name, v)
+			}
+		case <-timer.C:
+			t.Fatalf("%s after close: blocked", op.name)
+		}
+		timer.Stop()
+	}
+}
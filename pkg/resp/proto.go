@@ -0,0 +1,116 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Limits on commands sent by clients. Memory is used as data arrives, not when
+// a length is claimed, but a command must still fit in memory.
+const (
+	maxArgs    = 64 * 1024
+	maxBulkLen = 16 * 1024 * 1024
+)
+
+var errProtocol = errors.New("Protocol error")
+
+// Read a command, either as an array of bulk strings or as an inline command.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < -1 || n > maxArgs {
+		return nil, errProtocol
+	}
+	if n <= 0 {
+		// Null and empty arrays are empty commands.
+		return nil, nil
+	}
+	var args [][]byte
+	for i := 0; i < n; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, errProtocol
+		}
+		var buf bytes.Buffer
+		if _, err = io.CopyN(&buf, r, int64(size)+2); err != nil {
+			return nil, err
+		}
+		arg := buf.Bytes()
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, errProtocol
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// Read a line terminated by CRLF, or by LF for inline commands.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errProtocol
+	}
+	if err != nil {
+		if err == io.EOF && len(line) != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+	return line, nil
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	_, _ = w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, msg string) {
+	_, _ = w.WriteString("-ERR " + msg + "\r\n")
+}
+
+func writeArgsError(w *bufio.Writer, cmd string) {
+	writeError(w, fmt.Sprintf("wrong number of arguments for '%s' command",
+		cmd))
+}
+
+func writeInt(w *bufio.Writer, n int) {
+	_, _ = w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func writeBulk(w *bufio.Writer, data []byte) {
+	_, _ = w.WriteString("$" + strconv.Itoa(len(data)) + "\r\n")
+	_, _ = w.Write(data)
+	_, _ = w.WriteString("\r\n")
+}
+
+func writeNull(w *bufio.Writer) {
+	_, _ = w.WriteString("$-1\r\n")
+}
+
+func writeNullArray(w *bufio.Writer) {
+	_, _ = w.WriteString("*-1\r\n")
+}
+
+func writeArray(w *bufio.Writer, elems ...[]byte) {
+	_, _ = w.WriteString("*" + strconv.Itoa(len(elems)) + "\r\n")
+	for _, elem := range elems {
+		writeBulk(w, elem)
+	}
+}
@@ -0,0 +1,392 @@
+// Package resp serves queues over a subset of the Redis protocol (RESP), so
+// that Redis clients may use them as lists.
+//
+// The supported commands are PING, ECHO, QUIT, LPUSH, RPUSH, LPOP, RPOP, BLPOP,
+// BRPOP and LLEN. A queue is not a double-ended list: both push commands add
+// data to the back of the queue, and all pop commands remove data from the
+// front. Thus LPUSH with RPOP, or RPUSH with LPOP, behave as they do in Redis.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esote/queue"
+)
+
+// Opener returns the queue for a list name. It is called once per name.
+type Opener func(name string) (queue.Queue, error)
+
+// Server handles RESP connections.
+type Server struct {
+	open Opener
+	poll time.Duration
+
+	mu     sync.Mutex
+	lists  map[string]queue.Queue
+	notify chan struct{}
+	ls     map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	quit   chan struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewServer creates a server mapping list names to queues given by open.
+// Blocking pops check the queues every poll interval for data added other than
+// through the server.
+func NewServer(open Opener, poll time.Duration) (*Server, error) {
+	if open == nil {
+		return nil, errors.New("resp: open is nil")
+	}
+	if poll <= 0 {
+		return nil, errors.New("resp: poll <= 0")
+	}
+	return &Server{
+		open:   open,
+		poll:   poll,
+		lists:  make(map[string]queue.Queue),
+		notify: make(chan struct{}),
+		ls:     make(map[net.Listener]struct{}),
+		conns:  make(map[net.Conn]struct{}),
+		quit:   make(chan struct{}),
+	}, nil
+}
+
+// Serve connections accepted from l until the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("resp: serve on closed server")
+	}
+	s.ls[l] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return nil
+			default:
+				return err
+			}
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// Close the server, its listeners and connections, and the queues returned by
+// the opener.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("resp: close on closed server")
+	}
+	s.closed = true
+	close(s.quit)
+	var err error
+	for l := range s.ls {
+		if err2 := l.Close(); err == nil {
+			err = err2
+		}
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	for _, q := range s.lists {
+		if err2 := q.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+	c := &client{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+	for {
+		args, err := readCommand(c.r)
+		if err != nil {
+			if err != io.EOF {
+				writeError(c.w, err.Error())
+				_ = c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.exec(c, args)
+		if c.w.Flush() != nil || quit {
+			return
+		}
+	}
+}
+
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// Watch for the client closing its connection while a command blocks. The
+// returned channel is closed when it does. Stop must be called before reading
+// from the connection again.
+func (c *client) watch() (gone <-chan struct{}, stop func()) {
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Data is a command pipelined by the client, which is read
+		// once the blocking command finishes. Timeouts are caused by
+		// stop.
+		_, err := c.r.Peek(1)
+		var nerr net.Error
+		if err != nil && !(errors.As(err, &nerr) && nerr.Timeout()) {
+			close(closed)
+		}
+	}()
+	return closed, func() {
+		_ = c.conn.SetReadDeadline(time.Now())
+		<-done
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// Execute a command, writing its reply. Returns true if the connection should
+// be closed.
+func (s *Server) exec(c *client, args [][]byte) bool {
+	w := c.w
+	cmd := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	switch cmd {
+	case "PING":
+		if len(args) == 0 {
+			writeSimple(w, "PONG")
+		} else {
+			writeBulk(w, args[0])
+		}
+	case "ECHO":
+		if len(args) != 1 {
+			writeArgsError(w, cmd)
+			break
+		}
+		writeBulk(w, args[0])
+	case "QUIT":
+		writeSimple(w, "OK")
+		return true
+	case "LPUSH", "RPUSH":
+		s.push(w, cmd, args)
+	case "LPOP", "RPOP":
+		s.pop(w, cmd, args)
+	case "BLPOP", "BRPOP":
+		s.bpop(c, cmd, args)
+	case "LLEN":
+		s.llen(w, cmd, args)
+	default:
+		writeError(w, fmt.Sprintf("unknown command '%s'", cmd))
+	}
+	return false
+}
+
+// Get the queue for a list name, opening it on first use.
+func (s *Server) list(name string) (queue.Queue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q, ok := s.lists[name]; ok {
+		return q, nil
+	}
+	q, err := s.open(name)
+	if err != nil {
+		return nil, err
+	}
+	s.lists[name] = q
+	return q, nil
+}
+
+func (s *Server) push(w *bufio.Writer, cmd string, args [][]byte) {
+	if len(args) < 2 {
+		writeArgsError(w, cmd)
+		return
+	}
+	q, err := s.list(string(args[0]))
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	n := 0
+	for _, data := range args[1:] {
+		if err = q.Enqueue(data); err != nil {
+			break
+		}
+		n++
+	}
+	if n > 0 {
+		// Wake blocking pops.
+		s.mu.Lock()
+		close(s.notify)
+		s.notify = make(chan struct{})
+		s.mu.Unlock()
+	}
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	// Reply with the list length as Redis does, when it is known.
+	if lener, ok := q.(queue.Lener); ok {
+		if length, err := lener.Len(); err == nil {
+			n = length
+		}
+	}
+	writeInt(w, n)
+}
+
+func (s *Server) pop(w *bufio.Writer, cmd string, args [][]byte) {
+	if len(args) != 1 {
+		writeArgsError(w, cmd)
+		return
+	}
+	q, err := s.list(string(args[0]))
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	data, err := q.Dequeue()
+	switch {
+	case err == queue.ErrEmpty:
+		writeNull(w)
+	case err != nil:
+		writeError(w, err.Error())
+	default:
+		writeBulk(w, data)
+	}
+}
+
+func (s *Server) bpop(c *client, cmd string, args [][]byte) {
+	w := c.w
+	if len(args) < 2 {
+		writeArgsError(w, cmd)
+		return
+	}
+	secs, err := strconv.ParseFloat(string(args[len(args)-1]), 64)
+	if err != nil || secs < 0 {
+		writeError(w, "timeout is not a float or out of range")
+		return
+	}
+	names := args[:len(args)-1]
+	qs := make([]queue.Queue, len(names))
+	for i, name := range names {
+		if qs[i], err = s.list(string(name)); err != nil {
+			writeError(w, err.Error())
+			return
+		}
+	}
+	// A zero timeout blocks indefinitely.
+	var deadline <-chan time.Time
+	if secs > 0 {
+		timer := time.NewTimer(time.Duration(secs * float64(time.Second)))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	// Data popped for a client which has gone away would be lost.
+	gone, stop := c.watch()
+	defer stop()
+	for {
+		s.mu.Lock()
+		notify := s.notify
+		s.mu.Unlock()
+		for i, q := range qs {
+			select {
+			case <-gone:
+				return
+			default:
+			}
+			data, err := q.Dequeue()
+			switch {
+			case err == queue.ErrEmpty:
+				continue
+			case err != nil:
+				writeError(w, err.Error())
+			default:
+				writeArray(w, names[i], data)
+				if w.Flush() != nil {
+					// Keep the data, at the back of the queue.
+					_ = q.Enqueue(data)
+				}
+			}
+			return
+		}
+		poll := time.NewTimer(s.poll)
+		select {
+		case <-notify:
+		case <-gone:
+			poll.Stop()
+			return
+		case <-poll.C:
+		case <-deadline:
+			poll.Stop()
+			writeNullArray(w)
+			return
+		case <-s.quit:
+			poll.Stop()
+			writeError(w, "server closed")
+			return
+		}
+		poll.Stop()
+	}
+}
+
+func (s *Server) llen(w *bufio.Writer, cmd string, args [][]byte) {
+	if len(args) != 1 {
+		writeArgsError(w, cmd)
+		return
+	}
+	q, err := s.list(string(args[0]))
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	lener, ok := q.(queue.Lener)
+	if !ok {
+		writeError(w, "queue does not report its length")
+		return
+	}
+	n, err := lener.Len()
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	writeInt(w, n)
+}
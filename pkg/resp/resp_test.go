@@ -0,0 +1,271 @@
+package resp_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/internal/tmpdb"
+	"github.com/esote/queue/pkg/resp"
+)
+
+func TestMain(m *testing.M) {
+	ret := m.Run()
+	tmpdb.Clean()
+	os.Exit(ret)
+}
+
+// client is a minimal RESP client.
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr net.Addr) *client {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+// Send a command and return its reply, with nil standing for null replies.
+func (c *client) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *client) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil, nil
+		}
+		elems := make([]interface{}, n)
+		for i := range elems {
+			if elems[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func newServer(t *testing.T) (*resp.Server, net.Addr) {
+	open := func(name string) (queue.Queue, error) {
+		switch name {
+		case "memory":
+			return queue.NewMemoryQueue(), nil
+		case "sqlite3":
+			file, err := tmpdb.New()
+			if err != nil {
+				return nil, err
+			}
+			return queue.NewSqlite3Queue(file)
+		}
+		return nil, errors.New("no such queue")
+	}
+	s, err := resp.NewServer(open, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = s.Serve(l)
+	}()
+	return s, l.Addr()
+}
+
+func expect(t *testing.T, c *client, want interface{}, args ...string) {
+	t.Helper()
+	have, err := c.do(args...)
+	if err != nil {
+		t.Fatalf("%v: %s", args, err)
+	}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("%v: want %v, have %v", args, want, have)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	s, addr := newServer(t)
+	defer s.Close()
+	c := dial(t, addr)
+	defer c.conn.Close()
+	expect(t, c, "PONG", "PING")
+	for _, name := range []string{"memory", "sqlite3"} {
+		expect(t, c, 2, "LPUSH", name, "a", "b")
+		expect(t, c, 3, "RPUSH", name, "c")
+		expect(t, c, 3, "LLEN", name)
+		expect(t, c, "a", "RPOP", name)
+		expect(t, c, "b", "LPOP", name)
+		expect(t, c, []interface{}{name, "c"}, "BRPOP", name, "0")
+		expect(t, c, nil, "RPOP", name)
+		expect(t, c, nil, "BRPOP", name, "0.01")
+		expect(t, c, 0, "LLEN", name)
+	}
+	if _, err := c.do("LPUSH", "missing", "a"); err == nil {
+		t.Fatal("pushed to missing queue")
+	}
+	if _, err := c.do("LPUSH", "memory"); err == nil {
+		t.Fatal("pushed without values")
+	}
+	if _, err := c.do("SET", "k", "v"); err == nil {
+		t.Fatal("unsupported command succeeded")
+	}
+	expect(t, c, "OK", "QUIT")
+}
+
+func TestBlockingPop(t *testing.T) {
+	s, addr := newServer(t)
+	defer s.Close()
+	c1 := dial(t, addr)
+	defer c1.conn.Close()
+	c2 := dial(t, addr)
+	defer c2.conn.Close()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_, _ = c2.do("LPUSH", "sqlite3", "x")
+	}()
+	start := time.Now()
+	expect(t, c1, []interface{}{"sqlite3", "x"}, "BRPOP", "memory",
+		"sqlite3", "5")
+	if time.Since(start) > time.Second {
+		t.Fatal("blocking pop not woken by push")
+	}
+}
+
+// Data is not popped for a client which went away while blocked.
+func TestBlockingPopGone(t *testing.T) {
+	s, addr := newServer(t)
+	defer s.Close()
+	c1 := dial(t, addr)
+	if _, err := io.WriteString(c1.conn,
+		"*3\r\n$5\r\nBRPOP\r\n$6\r\nmemory\r\n$1\r\n0\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	_ = c1.conn.Close()
+	// Wait for the server to notice.
+	time.Sleep(20 * time.Millisecond)
+	c2 := dial(t, addr)
+	defer c2.conn.Close()
+	expect(t, c2, 1, "LPUSH", "memory", "x")
+	time.Sleep(20 * time.Millisecond)
+	expect(t, c2, 1, "LLEN", "memory")
+	// Blocking pops still work after commands pipelined behind them.
+	if _, err := io.WriteString(c2.conn,
+		"*3\r\n$5\r\nBRPOP\r\n$6\r\nmemory\r\n$1\r\n0\r\n"+
+			"*1\r\n$4\r\nPING\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []interface{}{[]interface{}{"memory", "x"}, "PONG"} {
+		if have, err := c2.read(); err != nil ||
+			fmt.Sprint(have) != fmt.Sprint(want) {
+			t.Fatalf("want %v, have %v (%v)", want, have, err)
+		}
+	}
+}
+
+// Malformed commands get a protocol error instead of crashing the server.
+func TestMalformed(t *testing.T) {
+	s, addr := newServer(t)
+	defer s.Close()
+	inputs := []string{
+		"*-2\r\n",
+		"*-9223372036854775808\r\n",
+		"*1\r\n$-1\r\n",
+		"*1\r\n$-5\r\n",
+		"*1\r\n+PING\r\n",
+		"*x\r\n",
+		"*65537\r\n",
+		"*1\r\n$16777217\r\n",
+	}
+	for _, input := range inputs {
+		c := dial(t, addr)
+		if _, err := io.WriteString(c.conn, input); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.read(); err == nil ||
+			!strings.Contains(err.Error(), "Protocol error") {
+			t.Fatalf("%q: unexpected reply (%v)", input, err)
+		}
+		_ = c.conn.Close()
+	}
+	// Null and empty arrays are ignored.
+	c := dial(t, addr)
+	defer c.conn.Close()
+	if _, err := io.WriteString(c.conn, "*-1\r\n*0\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, "PONG", "PING")
+}
+
+// Memory is not allocated for lengths claimed by clients until data arrives.
+func TestClaimedLength(t *testing.T) {
+	s, addr := newServer(t)
+	defer s.Close()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	const n = 10
+	for i := 0; i < n; i++ {
+		c := dial(t, addr)
+		defer c.conn.Close()
+		if _, err := io.WriteString(c.conn,
+			"*65536\r\n$16777216\r\nx"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for the server to read the lengths.
+	time.Sleep(50 * time.Millisecond)
+	runtime.ReadMemStats(&after)
+	if after.HeapAlloc > before.HeapAlloc+16*1024*1024 {
+		t.Fatalf("heap grew by %d bytes", after.HeapAlloc-before.HeapAlloc)
+	}
+}
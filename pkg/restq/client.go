@@ -0,0 +1,172 @@
+package restq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/esote/queue"
+)
+
+// Client is a queue stored by a remote server.
+type Client struct {
+	base   *url.URL
+	client *http.Client
+	wait   time.Duration
+
+	// Whether client was created by NewClient, and may be closed.
+	own bool
+}
+
+// NewClient creates a client for the server mounted at base. Dequeue waits up
+// to wait for data to become available before returning queue.ErrEmpty. If
+// client is nil, a client with its own transport is created, whose idle
+// connections are closed by Close.
+func NewClient(base string, client *http.Client, wait time.Duration) (*Client, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	own := client == nil
+	if own {
+		client = &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		}
+	}
+	return &Client{
+		base:   u,
+		client: client,
+		wait:   wait,
+		own:    own,
+	}, nil
+}
+
+// Enqueue data on the server. Safe for concurrent use.
+func (c *Client) Enqueue(data []byte) error {
+	resp, err := c.do(context.Background(), http.MethodPost, "enqueue", nil,
+		bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Dequeue data from the server and acknowledge it. Safe for concurrent use.
+func (c *Client) Dequeue() ([]byte, error) {
+	id, data, err := c.Receive(context.Background(), c.wait)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Ack(context.Background(), id); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Receive dequeues data from the server, waiting up to wait for data to become
+// available. The data must be acknowledged with Ack, otherwise the server
+// enqueues it again. Returns queue.ErrEmpty if no data is available.
+func (c *Client) Receive(ctx context.Context, wait time.Duration) (uint64, []byte, error) {
+	var query url.Values
+	if wait > 0 {
+		query = url.Values{"wait": {wait.String()}}
+	}
+	resp, err := c.do(ctx, http.MethodPost, "dequeue", query, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return 0, nil, queue.ErrEmpty
+	}
+	id, err := strconv.ParseUint(resp.Header.Get(IDHeader), 10, 64)
+	if err != nil {
+		return 0, nil, errors.New("restq: response has invalid id")
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, data, nil
+}
+
+// Ack acknowledges data received with the id.
+func (c *Client) Ack(ctx context.Context, id uint64) error {
+	query := url.Values{"id": {strconv.FormatUint(id, 10)}}
+	resp, err := c.do(ctx, http.MethodPost, "ack", query, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Stats retrieves statistics of the server's queue.
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	resp, err := c.do(ctx, http.MethodGet, "stats", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var stats Stats
+	if err = json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Len returns the number of items in the server's queue.
+func (c *Client) Len() (int, error) {
+	stats, err := c.Stats(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	if stats.Len < 0 {
+		return 0, errors.New("restq: server queue does not report its length")
+	}
+	return stats.Len, nil
+}
+
+// Close the client. The server's queue is unaffected, as is the *http.Client
+// given to NewClient.
+func (c *Client) Close() error {
+	if c.own {
+		c.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// Perform a request, returning an error for unsuccessful responses.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values,
+	body io.Reader) (*http.Response, error) {
+	u := c.base.ResolveReference(&url.URL{
+		Path:     path,
+		RawQuery: query.Encode(),
+	})
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("restq: %s: %s", resp.Status,
+			bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
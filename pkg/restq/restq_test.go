@@ -0,0 +1,199 @@
+package restq_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/pkg/queuetest"
+	"github.com/esote/queue/pkg/restq"
+)
+
+func newServer(t *testing.T, cfg *restq.Config) (*restq.Server,
+	*restq.Client, func()) {
+	s, err := restq.NewServer(queue.NewMemoryQueue(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/q/", http.StripPrefix("/q", s))
+	ts := httptest.NewServer(mux)
+	c, err := restq.NewClient(ts.URL+"/q", ts.Client(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c, func() {
+		_ = c.Close()
+		ts.Close()
+		_ = s.Close()
+	}
+}
+
+func TestClientQueue(t *testing.T) {
+	_, c, done := newServer(t, nil)
+	defer done()
+	const n byte = 5
+	for i := byte(0); i < n; i++ {
+		if err := c.Enqueue([]byte{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l, err := c.Len(); err != nil || l != int(n) {
+		t.Fatalf("want len %d, have %d (%v)", n, l, err)
+	}
+	for i := byte(0); i < n; i++ {
+		data, err := c.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 1 || data[0] != i {
+			t.Fatalf("want %d, have %v", i, data)
+		}
+	}
+	if _, err := c.Dequeue(); err != queue.ErrEmpty {
+		t.Fatalf("want ErrEmpty, have %v", err)
+	}
+	stats, err := c.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := restq.Stats{
+		Enqueued: uint64(n),
+		Dequeued: uint64(n),
+		Acked:    uint64(n),
+	}
+	if *stats != want {
+		t.Fatalf("want %+v, have %+v", want, *stats)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	_, c, done := newServer(t, nil)
+	defer done()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = c.Enqueue([]byte("late"))
+	}()
+	start := time.Now()
+	_, data, err := c.Receive(context.Background(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "late" {
+		t.Fatalf("unexpected data %s", data)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("waiting receive not woken by enqueue")
+	}
+	_, _, err = c.Receive(context.Background(), 10*time.Millisecond)
+	if err != queue.ErrEmpty {
+		t.Fatalf("want ErrEmpty, have %v", err)
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	cfg := &restq.Config{
+		AckTimeout:   20 * time.Millisecond,
+		MaxWait:      time.Second,
+		PollInterval: time.Second,
+	}
+	_, c, done := newServer(t, cfg)
+	defer done()
+	if err := c.Enqueue([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := c.Receive(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not acknowledged, so it is delivered again.
+	id2, data, err := c.Receive(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "x" || id2 == id {
+		t.Fatalf("unexpected redelivery %d %s", id2, data)
+	}
+	if err = c.Ack(context.Background(), id); err == nil {
+		t.Fatal("acknowledged expired id")
+	}
+	if err = c.Ack(context.Background(), id2); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := c.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Redelivered != 1 || stats.InFlight != 0 || stats.Len != 0 {
+		t.Fatalf("unexpected stats %+v", *stats)
+	}
+}
+
+func TestAsyncClient(t *testing.T) {
+	_, c, done := newServer(t, nil)
+	defer done()
+	got := make(chan string, 1)
+	handler := func(data []byte, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		got <- string(data)
+	}
+	q, err := queue.NewAsyncQueue(c, handler, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.Enqueue([]byte("remote")); err != nil {
+		t.Fatal(err)
+	}
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	select {
+	case data := <-got:
+		if data != "remote" {
+			t.Fatalf("unexpected data %s", data)
+		}
+	case <-timer.C:
+		t.Fatal("data not handled")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	queuetest.Run(t, func() (queue.Queue, error) {
+		_, c, done := newServer(t, nil)
+		t.Cleanup(done)
+		return c, nil
+	})
+}
+
+// Transport counting calls to CloseIdleConnections.
+type idleCounter struct {
+	http.RoundTripper
+	closed int
+}
+
+func (t *idleCounter) CloseIdleConnections() {
+	t.closed++
+}
+
+// Closing the client leaves the connections of a given http.Client alone.
+func TestClientClose(t *testing.T) {
+	rt := &idleCounter{RoundTripper: http.DefaultTransport}
+	c, err := restq.NewClient("http://localhost/q", &http.Client{
+		Transport: rt,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rt.closed != 0 {
+		t.Fatal("idle connections of given client closed")
+	}
+}
@@ -0,0 +1,292 @@
+// Package restq exposes a queue.Queue over HTTP, and provides a client which
+// is itself a queue.Queue.
+//
+// The server handles the following requests, relative to where it is mounted:
+//
+//	POST /enqueue         enqueue the request body
+//	POST /dequeue?wait=d  dequeue data, waiting up to duration d for some
+//	POST /ack?id=n        acknowledge dequeued data
+//	GET  /stats           report queue statistics as JSON
+//
+// Dequeued data is returned as the response body with its id in the X-Queue-Id
+// header, or with status 204 when the queue stays empty. Dequeued data is
+// removed from the queue and kept in memory until it is acknowledged. Data
+// which is not acknowledged in time, or by the time the server is closed, is
+// enqueued again, so data is delivered at least once while the server process
+// stays up; unacknowledged data is lost if it crashes, even when the queue is
+// durable.
+package restq
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/esote/queue"
+)
+
+// IDHeader contains the id of dequeued data.
+const IDHeader = "X-Queue-Id"
+
+// Config is used to configure the behaviour of the server.
+type Config struct {
+	// How long dequeued data may go unacknowledged before it is enqueued
+	// again.
+	AckTimeout time.Duration
+
+	// Maximum time a dequeue request may wait for data.
+	MaxWait time.Duration
+
+	// How often waiting dequeue requests check the queue for data added
+	// other than through the server.
+	PollInterval time.Duration
+}
+
+// Stats describes the server's queue.
+type Stats struct {
+	// Number of items in the queue, or -1 if the queue does not implement
+	// queue.Lener.
+	Len         int    `json:"len"`
+	InFlight    int    `json:"inflight"`
+	Enqueued    uint64 `json:"enqueued"`
+	Dequeued    uint64 `json:"dequeued"`
+	Acked       uint64 `json:"acked"`
+	Redelivered uint64 `json:"redelivered"`
+}
+
+type inflight struct {
+	data  []byte
+	timer *time.Timer
+}
+
+// Server exposes a queue over HTTP.
+type Server struct {
+	q   queue.Queue
+	cfg Config
+	mux *http.ServeMux
+
+	mu       sync.Mutex
+	nextID   uint64
+	inflight map[uint64]*inflight
+	notify   chan struct{}
+	stats    Stats
+	closed   bool
+}
+
+// NewServer creates a server for q. When a nil config is given, reasonable
+// defaults will be used. Closing the server does NOT close q.
+func NewServer(q queue.Queue, cfg *Config) (*Server, error) {
+	if q == nil {
+		return nil, errors.New("restq: q is nil")
+	}
+	if cfg == nil {
+		cfg = &Config{
+			AckTimeout:   30 * time.Second,
+			MaxWait:      30 * time.Second,
+			PollInterval: time.Second,
+		}
+	} else if cfg.AckTimeout <= 0 || cfg.PollInterval <= 0 {
+		return nil, errors.New("restq: config has invalid durations")
+	}
+	s := &Server{
+		q:        q,
+		cfg:      *cfg,
+		mux:      http.NewServeMux(),
+		inflight: make(map[uint64]*inflight),
+		notify:   make(chan struct{}),
+	}
+	s.mux.HandleFunc("/enqueue", s.enqueue)
+	s.mux.HandleFunc("/dequeue", s.dequeue)
+	s.mux.HandleFunc("/ack", s.ack)
+	s.mux.HandleFunc("/stats", s.statistics)
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close the server, enqueueing unacknowledged data again.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("restq: close on closed server")
+	}
+	s.closed = true
+	var err error
+	for id, m := range s.inflight {
+		m.timer.Stop()
+		delete(s.inflight, id)
+		if err2 := s.q.Enqueue(m.data); err == nil {
+			err = err2
+		}
+	}
+	close(s.notify)
+	return err
+}
+
+func (s *Server) enqueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = s.q.Enqueue(data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	s.stats.Enqueued++
+	s.wake()
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Wake waiting dequeue requests. Must be called with s.mu held.
+func (s *Server) wake() {
+	if !s.closed {
+		close(s.notify)
+		s.notify = make(chan struct{})
+	}
+}
+
+func (s *Server) dequeue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		var err error
+		if wait, err = time.ParseDuration(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if wait > s.cfg.MaxWait {
+			wait = s.cfg.MaxWait
+		}
+	}
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			http.Error(w, "server closed", http.StatusServiceUnavailable)
+			return
+		}
+		notify := s.notify
+		s.mu.Unlock()
+
+		data, err := s.q.Dequeue()
+		switch {
+		case err == nil:
+			s.deliver(w, data)
+			return
+		case err != queue.ErrEmpty:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		poll := time.NewTimer(s.cfg.PollInterval)
+		select {
+		case <-notify:
+		case <-poll.C:
+		case <-deadline.C:
+			poll.Stop()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			poll.Stop()
+			return
+		}
+		poll.Stop()
+	}
+}
+
+func (s *Server) deliver(w http.ResponseWriter, data []byte) {
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.inflight[id] = &inflight{
+		data: data,
+		timer: time.AfterFunc(s.cfg.AckTimeout, func() {
+			s.redeliver(id)
+		}),
+	}
+	s.stats.Dequeued++
+	s.mu.Unlock()
+	w.Header().Set(IDHeader, strconv.FormatUint(id, 10))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(data)
+}
+
+func (s *Server) redeliver(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.inflight[id]
+	if !ok || s.closed {
+		return
+	}
+	delete(s.inflight, id)
+	// If enqueueing fails the data is lost, as there is nobody to report
+	// the error to.
+	if s.q.Enqueue(m.data) == nil {
+		s.stats.Redelivered++
+		s.wake()
+	}
+}
+
+func (s *Server) ack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	m, ok := s.inflight[id]
+	if ok {
+		m.timer.Stop()
+		delete(s.inflight, id)
+		s.stats.Acked++
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown id", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) statistics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	stats := s.stats
+	stats.InFlight = len(s.inflight)
+	s.mu.Unlock()
+	stats.Len = -1
+	if l, ok := s.q.(queue.Lener); ok {
+		var err error
+		if stats.Len, err = l.Len(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&stats)
+}
@@ -0,0 +1,186 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits on frames sent by clients.
+const (
+	maxHeaders  = 1024
+	maxLineSize = 64 * 1024
+	maxBodySize = 64 * 1024 * 1024
+)
+
+var (
+	errFrame    = errors.New("stomp: malformed frame")
+	errTooLarge = errors.New("stomp: frame too large")
+)
+
+type frame struct {
+	command string
+	header  map[string]string
+	body    []byte
+}
+
+// Read a frame, skipping heart-beats.
+func readFrame(r *bufio.Reader) (*frame, error) {
+	var line string
+	for line == "" {
+		var err error
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+	}
+	f := &frame{
+		command: line,
+		header:  make(map[string]string),
+	}
+	// Header values of CONNECT frames are not escaped, for compatibility
+	// with STOMP 1.0.
+	escaped := f.command != "CONNECT"
+	for i := 0; ; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		if line == "" {
+			break
+		}
+		if i == maxHeaders {
+			return nil, errTooLarge
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			return nil, errFrame
+		}
+		key, value := line[:colon], line[colon+1:]
+		if escaped {
+			if key, err = unescape(key); err != nil {
+				return nil, err
+			}
+			if value, err = unescape(value); err != nil {
+				return nil, err
+			}
+		}
+		// Only the first occurrence of a repeated header is used.
+		if _, ok := f.header[key]; !ok {
+			f.header[key] = value
+		}
+	}
+	if v, ok := f.header["content-length"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errFrame
+		}
+		if n > maxBodySize {
+			return nil, errTooLarge
+		}
+		// Read as the body arrives, rather than allocating the claimed
+		// length up front.
+		var body bytes.Buffer
+		if _, err = io.CopyN(&body, r, int64(n)+1); err != nil {
+			return nil, noEOF(err)
+		}
+		f.body = body.Bytes()
+		if f.body[n] != 0 {
+			return nil, errFrame
+		}
+		f.body = f.body[:n]
+		return f, nil
+	}
+	var body bytes.Buffer
+	for {
+		chunk, err := r.ReadSlice(0)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, noEOF(err)
+		}
+		if body.Len()+len(chunk) > maxBodySize {
+			return nil, errTooLarge
+		}
+		body.Write(chunk)
+		if err == nil {
+			break
+		}
+	}
+	f.body = body.Bytes()[:body.Len()-1]
+	return f, nil
+}
+
+// Read a line ending in LF or CRLF.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxLineSize {
+		return "", errTooLarge
+	}
+	if err != nil {
+		return "", err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+	return string(line), nil
+}
+
+// Once a frame has begun, EOF means it was cut short.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+var escaper = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n",
+	":", "\\c")
+
+func unescape(s string) (string, error) {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", errFrame
+		}
+		switch s[i] {
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			return "", errFrame
+		}
+	}
+	return b.String(), nil
+}
+
+// Write a frame with headers given as key, value pairs.
+func writeFrame(w *bufio.Writer, command string, body []byte,
+	header ...string) error {
+	_, _ = w.WriteString(command + "\n")
+	for i := 0; i+1 < len(header); i += 2 {
+		key, value := header[i], header[i+1]
+		if command != "CONNECTED" {
+			key, value = escaper.Replace(key), escaper.Replace(value)
+		}
+		_, _ = w.WriteString(key + ":" + value + "\n")
+	}
+	if body != nil {
+		_, _ = w.WriteString("content-length:" +
+			strconv.Itoa(len(body)) + "\n")
+	}
+	_, _ = w.WriteString("\n")
+	_, _ = w.Write(body)
+	_ = w.WriteByte(0)
+	return w.Flush()
+}
@@ -0,0 +1,549 @@
+// Package stomp implements a STOMP 1.2 server which maps destinations onto
+// queues.
+//
+// Clients may CONNECT (or STOMP), SEND, SUBSCRIBE, UNSUBSCRIBE, ACK, NACK and
+// DISCONNECT. Heart-beating and transactions are not supported. Each
+// destination is a queue, so a message sent to a destination is received by
+// only one of its subscribers.
+//
+// Messages are removed from their queue when they are sent to a subscriber. In
+// the client and client-individual ack modes, sent messages are kept in memory
+// until they are acknowledged: messages which are negatively acknowledged, or
+// still unacknowledged when the subscription ends or the server is closed, are
+// enqueued again. Delivery is at least once only while the server process
+// stays up; unacknowledged messages are lost if it crashes, even when the
+// queue is durable.
+package stomp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esote/queue"
+)
+
+// Opener returns the queue for a destination. It is called once per
+// destination.
+type Opener func(destination string) (queue.Queue, error)
+
+// Config is used to configure the behaviour of the server. No setting makes
+// unacknowledged messages durable: they are kept only in memory, whatever the
+// destination queues.
+type Config struct {
+	// Number of workers delivering messages to each subscription.
+	Workers int
+
+	// Maximum number of unacknowledged messages per subscription in the
+	// client and client-individual ack modes. These messages are lost if
+	// the process crashes.
+	MaxPending int
+
+	// How often idle workers check destinations for messages added other
+	// than through the server.
+	PollInterval time.Duration
+
+	// Errors from destination queues.
+	Errors chan<- error
+}
+
+type destination struct {
+	q      queue.Queue
+	notify chan struct{}
+}
+
+// Server handles STOMP connections.
+type Server struct {
+	open Opener
+	cfg  Config
+
+	mu     sync.Mutex
+	dests  map[string]*destination
+	ls     map[net.Listener]struct{}
+	conns  map[*conn]struct{}
+	quit   chan struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewServer creates a server mapping destinations to queues given by open. When
+// a nil config is given, reasonable defaults will be used.
+func NewServer(open Opener, cfg *Config) (*Server, error) {
+	if open == nil {
+		return nil, errors.New("stomp: open is nil")
+	}
+	if cfg == nil {
+		cfg = &Config{
+			Workers:      1,
+			MaxPending:   16,
+			PollInterval: time.Second,
+		}
+	} else if cfg.Workers <= 0 || cfg.MaxPending <= 0 ||
+		cfg.PollInterval <= 0 {
+		return nil, errors.New("stomp: invalid config")
+	}
+	return &Server{
+		open:  open,
+		cfg:   *cfg,
+		dests: make(map[string]*destination),
+		ls:    make(map[net.Listener]struct{}),
+		conns: make(map[*conn]struct{}),
+		quit:  make(chan struct{}),
+	}, nil
+}
+
+// Serve connections accepted from l until the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("stomp: serve on closed server")
+	}
+	s.ls[l] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return nil
+			default:
+				return err
+			}
+		}
+		c := &conn{
+			s:       s,
+			nc:      nc,
+			r:       bufio.NewReader(nc),
+			w:       bufio.NewWriter(nc),
+			subs:    make(map[string]*subscription),
+			pending: make(map[string]*pending),
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = nc.Close()
+			return nil
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go c.serve()
+	}
+}
+
+// Close the server, its listeners and connections, and the queues returned by
+// the opener. Unacknowledged messages are enqueued again.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("stomp: close on closed server")
+	}
+	s.closed = true
+	close(s.quit)
+	var err error
+	for l := range s.ls {
+		if err2 := l.Close(); err == nil {
+			err = err2
+		}
+	}
+	for c := range s.conns {
+		_ = c.nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	for _, d := range s.dests {
+		if err2 := d.q.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Get a destination, opening its queue on first use.
+func (s *Server) destination(name string) (*destination, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.dests[name]; ok {
+		return d, nil
+	}
+	q, err := s.open(name)
+	if err != nil {
+		return nil, err
+	}
+	d := &destination{
+		q:      q,
+		notify: make(chan struct{}),
+	}
+	s.dests[name] = d
+	return d, nil
+}
+
+// Enqueue a message and wake the destination's idle workers.
+func (s *Server) enqueue(d *destination, data []byte) error {
+	if err := d.q.Enqueue(data); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	close(d.notify)
+	d.notify = make(chan struct{})
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Server) log(err error) {
+	if s.cfg.Errors != nil {
+		select {
+		case s.cfg.Errors <- err:
+		default:
+		}
+	}
+}
+
+type conn struct {
+	s  *Server
+	nc net.Conn
+	r  *bufio.Reader
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu      sync.Mutex
+	subs    map[string]*subscription
+	pending map[string]*pending
+	nextID  uint64
+}
+
+type subscription struct {
+	id    string
+	dest  string
+	d     *destination
+	ack   string
+	slots chan struct{}
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Message awaiting acknowledgement.
+type pending struct {
+	sub  *subscription
+	seq  uint64
+	data []byte
+}
+
+func (c *conn) serve() {
+	defer c.s.wg.Done()
+	defer func() {
+		// Close first so that workers are not stuck writing.
+		_ = c.nc.Close()
+		c.mu.Lock()
+		subs := c.subs
+		c.subs = nil
+		c.mu.Unlock()
+		for _, sub := range subs {
+			c.unsubscribe(sub)
+		}
+		c.s.mu.Lock()
+		delete(c.s.conns, c)
+		c.s.mu.Unlock()
+	}()
+	connected := false
+	for {
+		f, err := readFrame(c.r)
+		if err != nil {
+			if connected && err != errFrame && err != errTooLarge {
+				return
+			}
+			c.error(err.Error())
+			return
+		}
+		if !connected {
+			if f.command != "CONNECT" && f.command != "STOMP" {
+				c.error("not connected")
+				return
+			}
+			if !c.connect(f) {
+				return
+			}
+			connected = true
+			continue
+		}
+		var msg string
+		switch f.command {
+		case "SEND":
+			msg = c.send(f)
+		case "SUBSCRIBE":
+			msg = c.subscribe(f)
+		case "UNSUBSCRIBE":
+			msg = c.unsubscribeFrame(f)
+		case "ACK", "NACK":
+			msg = c.ack(f)
+		case "DISCONNECT":
+			c.receipt(f)
+			return
+		default:
+			msg = "unsupported command " + f.command
+		}
+		if msg != "" {
+			c.error(msg)
+			return
+		}
+		c.receipt(f)
+	}
+}
+
+func (c *conn) write(command string, body []byte, header ...string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return writeFrame(c.w, command, body, header...)
+}
+
+func (c *conn) error(msg string) {
+	_ = c.write("ERROR", nil, "message", msg)
+}
+
+func (c *conn) receipt(f *frame) {
+	if id, ok := f.header["receipt"]; ok {
+		_ = c.write("RECEIPT", nil, "receipt-id", id)
+	}
+}
+
+func (c *conn) connect(f *frame) bool {
+	if v, ok := f.header["accept-version"]; ok && !acceptsVersion(v) {
+		_ = c.write("ERROR", nil, "version", "1.2", "message",
+			"supported protocol version is 1.2")
+		return false
+	}
+	return c.write("CONNECTED", nil, "version", "1.2", "heart-beat",
+		"0,0", "server", "queue-stomp") == nil
+}
+
+func acceptsVersion(versions string) bool {
+	for _, v := range strings.Split(versions, ",") {
+		if v == "1.2" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *conn) send(f *frame) string {
+	name, ok := f.header["destination"]
+	if !ok {
+		return "missing destination header"
+	}
+	d, err := c.s.destination(name)
+	if err != nil {
+		return err.Error()
+	}
+	if err = c.s.enqueue(d, f.body); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func (c *conn) subscribe(f *frame) string {
+	id, ok := f.header["id"]
+	if !ok {
+		return "missing id header"
+	}
+	name, ok := f.header["destination"]
+	if !ok {
+		return "missing destination header"
+	}
+	ack := f.header["ack"]
+	switch ack {
+	case "":
+		ack = "auto"
+	case "auto", "client", "client-individual":
+	default:
+		return "invalid ack mode " + ack
+	}
+	d, err := c.s.destination(name)
+	if err != nil {
+		return err.Error()
+	}
+	sub := &subscription{
+		id:    id,
+		dest:  name,
+		d:     d,
+		ack:   ack,
+		slots: make(chan struct{}, c.s.cfg.MaxPending),
+		quit:  make(chan struct{}),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subs[id]; ok {
+		return "duplicate subscription id " + id
+	}
+	c.subs[id] = sub
+	sub.wg.Add(c.s.cfg.Workers)
+	for i := 0; i < c.s.cfg.Workers; i++ {
+		go c.consume(sub)
+	}
+	return ""
+}
+
+func (c *conn) unsubscribeFrame(f *frame) string {
+	id, ok := f.header["id"]
+	if !ok {
+		return "missing id header"
+	}
+	c.mu.Lock()
+	sub, ok := c.subs[id]
+	delete(c.subs, id)
+	c.mu.Unlock()
+	if !ok {
+		return "unknown subscription id " + id
+	}
+	c.unsubscribe(sub)
+	return ""
+}
+
+// Stop the subscription's workers and enqueue its unacknowledged messages
+// again.
+func (c *conn) unsubscribe(sub *subscription) {
+	close(sub.quit)
+	sub.wg.Wait()
+	c.mu.Lock()
+	var datas [][]byte
+	for id, p := range c.pending {
+		if p.sub == sub {
+			datas = append(datas, p.data)
+			delete(c.pending, id)
+		}
+	}
+	c.mu.Unlock()
+	for _, data := range datas {
+		if err := c.s.enqueue(sub.d, data); err != nil {
+			c.s.log(err)
+		}
+	}
+}
+
+func (c *conn) ack(f *frame) string {
+	id, ok := f.header["id"]
+	if !ok {
+		return "missing id header"
+	}
+	c.mu.Lock()
+	p, ok := c.pending[id]
+	if !ok {
+		c.mu.Unlock()
+		return "unknown ack id " + id
+	}
+	acked := []*pending{p}
+	delete(c.pending, id)
+	if p.sub.ack == "client" {
+		// Acknowledgement is cumulative in the client ack mode.
+		for id2, p2 := range c.pending {
+			if p2.sub == p.sub && p2.seq < p.seq {
+				acked = append(acked, p2)
+				delete(c.pending, id2)
+			}
+		}
+	}
+	c.mu.Unlock()
+	for _, p := range acked {
+		if f.command == "NACK" {
+			if err := c.s.enqueue(p.sub.d, p.data); err != nil {
+				c.s.log(err)
+			}
+		}
+		<-p.sub.slots
+	}
+	return ""
+}
+
+func (c *conn) consume(sub *subscription) {
+	defer sub.wg.Done()
+	for {
+		if sub.ack != "auto" {
+			// Limit unacknowledged messages.
+			select {
+			case sub.slots <- struct{}{}:
+			case <-sub.quit:
+				return
+			}
+		}
+		data, ok := c.dequeue(sub)
+		if !ok {
+			if sub.ack != "auto" {
+				<-sub.slots
+			}
+			return
+		}
+		if !c.deliver(sub, data) {
+			return
+		}
+	}
+}
+
+// Dequeue from the subscription's destination, waiting for data. Returns false
+// if the subscription ends first.
+func (c *conn) dequeue(sub *subscription) ([]byte, bool) {
+	for {
+		c.s.mu.Lock()
+		notify := sub.d.notify
+		c.s.mu.Unlock()
+		data, err := sub.d.q.Dequeue()
+		if err == nil {
+			return data, true
+		}
+		if err != queue.ErrEmpty {
+			c.s.log(err)
+		}
+		poll := time.NewTimer(c.s.cfg.PollInterval)
+		select {
+		case <-notify:
+		case <-poll.C:
+		case <-sub.quit:
+			poll.Stop()
+			return nil, false
+		}
+		poll.Stop()
+	}
+}
+
+// Write a message to the subscriber. Returns false if the connection failed.
+func (c *conn) deliver(sub *subscription, data []byte) bool {
+	c.mu.Lock()
+	c.nextID++
+	seq := c.nextID
+	id := strconv.FormatUint(seq, 10)
+	if sub.ack != "auto" {
+		c.pending[id] = &pending{
+			sub:  sub,
+			seq:  seq,
+			data: data,
+		}
+	}
+	c.mu.Unlock()
+	header := []string{
+		"subscription", sub.id,
+		"message-id", id,
+		"destination", sub.dest,
+	}
+	if sub.ack != "auto" {
+		header = append(header, "ack", id)
+	}
+	if err := c.write("MESSAGE", data, header...); err != nil {
+		// Unacknowledged messages are enqueued again when the
+		// subscription ends; do the same for a lost auto message.
+		if sub.ack == "auto" {
+			if err = c.s.enqueue(sub.d, data); err != nil {
+				c.s.log(err)
+			}
+		}
+		_ = c.nc.Close()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,254 @@
+package stomp_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+	"github.com/esote/queue/pkg/stomp"
+)
+
+// client is a minimal STOMP client.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type frame struct {
+	command string
+	header  map[string]string
+	body    string
+}
+
+func newServer(t *testing.T) (*stomp.Server, map[string]queue.Queue,
+	net.Addr) {
+	queues := map[string]queue.Queue{
+		"/queue/a": queue.NewMemoryQueue(),
+		"/queue/b": queue.NewMemoryQueue(),
+	}
+	open := func(dest string) (queue.Queue, error) {
+		q, ok := queues[dest]
+		if !ok {
+			return nil, fmt.Errorf("no destination %s", dest)
+		}
+		return q, nil
+	}
+	cfg := &stomp.Config{
+		Workers:      2,
+		MaxPending:   4,
+		PollInterval: time.Second,
+	}
+	s, err := stomp.NewServer(open, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = s.Serve(l)
+	}()
+	return s, queues, l.Addr()
+}
+
+func dial(t *testing.T, addr net.Addr) *client {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{
+		t:    t,
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+	c.send("CONNECT", "", "accept-version", "1.0,1.2", "host", "localhost")
+	if f := c.read(); f.command != "CONNECTED" || f.header["version"] != "1.2" {
+		t.Fatalf("unexpected frame %v", f)
+	}
+	return c
+}
+
+func (c *client) send(command, body string, header ...string) {
+	var b strings.Builder
+	b.WriteString(command + "\n")
+	for i := 0; i < len(header); i += 2 {
+		b.WriteString(header[i] + ":" + header[i+1] + "\n")
+	}
+	b.WriteString("\n" + body + "\x00")
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) read() *frame {
+	_ = c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	raw, err := c.r.ReadString(0)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	raw = strings.TrimLeft(raw, "\n")
+	head, body := raw, ""
+	if i := strings.Index(raw, "\n\n"); i >= 0 {
+		head, body = raw[:i], raw[i+2:]
+	}
+	lines := strings.Split(head, "\n")
+	f := &frame{
+		command: lines[0],
+		header:  make(map[string]string),
+		body:    strings.TrimSuffix(body, "\x00"),
+	}
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(line, ":", 2)
+		f.header[kv[0]] = kv[1]
+	}
+	return f
+}
+
+// Expect no frame within a short time.
+func (c *client) none() {
+	_ = c.conn.SetReadDeadline(time.Now().Add(30 * time.Millisecond))
+	if _, err := c.r.Peek(1); err == nil {
+		c.t.Fatalf("unexpected frame %v", c.read())
+	}
+}
+
+func (c *client) message(body string) *frame {
+	f := c.read()
+	if f.command != "MESSAGE" || f.body != body {
+		c.t.Fatalf("want MESSAGE %s, have %v", body, f)
+	}
+	return f
+}
+
+func TestSendSubscribe(t *testing.T) {
+	s, queues, addr := newServer(t)
+	defer s.Close()
+	c := dial(t, addr)
+	c.send("SEND", "hello", "destination", "/queue/a", "receipt", "r1")
+	if f := c.read(); f.command != "RECEIPT" || f.header["receipt-id"] != "r1" {
+		t.Fatalf("unexpected frame %v", f)
+	}
+	c.send("SUBSCRIBE", "", "id", "0", "destination", "/queue/a")
+	f := c.message("hello")
+	if f.header["subscription"] != "0" || f.header["destination"] != "/queue/a" {
+		t.Fatalf("unexpected headers %v", f.header)
+	}
+	// Body containing NUL.
+	c.send("SEND", "a\x00b", "destination", "/queue/b", "content-length",
+		"3", "receipt", "r2")
+	if f := c.read(); f.command != "RECEIPT" {
+		t.Fatalf("unexpected frame %v", f)
+	}
+	if data, err := queues["/queue/b"].Dequeue(); err != nil ||
+		string(data) != "a\x00b" {
+		t.Fatalf("unexpected data %q (%v)", data, err)
+	}
+	c.send("DISCONNECT", "", "receipt", "bye")
+	if f := c.read(); f.command != "RECEIPT" || f.header["receipt-id"] != "bye" {
+		t.Fatalf("unexpected frame %v", f)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s, _, addr := newServer(t)
+	defer s.Close()
+	c := dial(t, addr)
+	c.send("SEND", "x", "destination", "/queue/missing")
+	if f := c.read(); f.command != "ERROR" {
+		t.Fatalf("want ERROR, have %v", f)
+	}
+	c = dial(t, addr)
+	c.send("SUBSCRIBE", "", "id", "0", "destination", "/queue/a", "ack",
+		"bogus")
+	if f := c.read(); f.command != "ERROR" {
+		t.Fatalf("want ERROR, have %v", f)
+	}
+}
+
+func TestClientIndividual(t *testing.T) {
+	s, queues, addr := newServer(t)
+	defer s.Close()
+	c := dial(t, addr)
+	c.send("SEND", "x", "destination", "/queue/b")
+	c.send("SUBSCRIBE", "", "id", "sub", "destination", "/queue/b", "ack",
+		"client-individual")
+	f := c.message("x")
+	// Negative acknowledgement delivers the message again.
+	c.send("NACK", "", "id", f.header["ack"])
+	f = c.message("x")
+	c.send("ACK", "", "id", f.header["ack"], "receipt", "acked")
+	if f := c.read(); f.command != "RECEIPT" {
+		t.Fatalf("want RECEIPT, have %v", f)
+	}
+	c.none()
+	if n, _ := queues["/queue/b"].(queue.Lener).Len(); n != 0 {
+		t.Fatalf("want empty queue, have %d", n)
+	}
+
+	// Messages unacknowledged on disconnect are enqueued again.
+	c.send("SEND", "y", "destination", "/queue/b")
+	c.message("y")
+	c.conn.Close()
+	c = dial(t, addr)
+	c.send("SUBSCRIBE", "", "id", "sub", "destination", "/queue/b", "ack",
+		"client-individual")
+	c.message("y")
+}
+
+func TestClientCumulative(t *testing.T) {
+	s, queues, addr := newServer(t)
+	defer s.Close()
+	c := dial(t, addr)
+	for _, body := range []string{"1", "2", "3"} {
+		c.send("SEND", body, "destination", "/queue/a")
+	}
+	c.send("SUBSCRIBE", "", "id", "sub", "destination", "/queue/a", "ack",
+		"client")
+	var last *frame
+	for i := 0; i < 3; i++ {
+		last = c.read()
+	}
+	c.send("ACK", "", "id", last.header["ack"], "receipt", "r")
+	if f := c.read(); f.command != "RECEIPT" {
+		t.Fatalf("want RECEIPT, have %v", f)
+	}
+	// Acknowledging the last message acknowledged all earlier messages.
+	c.send("UNSUBSCRIBE", "", "id", "sub", "receipt", "r")
+	if f := c.read(); f.command != "RECEIPT" {
+		t.Fatalf("want RECEIPT, have %v", f)
+	}
+	if n, _ := queues["/queue/a"].(queue.Lener).Len(); n != 0 {
+		t.Fatalf("want empty queue, have %d", n)
+	}
+}
+
+// Memory is not allocated for content lengths claimed by clients until the body
+// arrives.
+func TestClaimedLength(t *testing.T) {
+	s, _, addr := newServer(t)
+	defer s.Close()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 10; i++ {
+		c := dial(t, addr)
+		defer c.conn.Close()
+		if _, err := c.conn.Write([]byte("SEND\ndestination:/queue/a\n" +
+			"content-length:67108864\n\nx")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for the server to read the headers.
+	time.Sleep(50 * time.Millisecond)
+	runtime.ReadMemStats(&after)
+	if after.HeapAlloc > before.HeapAlloc+16*1024*1024 {
+		t.Fatalf("heap grew by %d bytes", after.HeapAlloc-before.HeapAlloc)
+	}
+}
@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// PollConfig is used to configure polling of the inner queue, so that data
+// added by other processes, or directly to the inner queue, is handled
+// without waiting for the next Enqueue on the async queue. Queues which
+// implement Changer are only dequeued from when they report a change.
+type PollConfig struct {
+	// Delay between polls.
+	Interval time.Duration
+
+	// Polls which find no new data double the delay, up to MaxInterval.
+	// Zero means the delay is always Interval.
+	MaxInterval time.Duration
+}
+
+func (cfg *PollConfig) check() error {
+	if cfg.Interval <= 0 {
+		return errors.New("queue: async: poll interval <= 0")
+	}
+	if cfg.MaxInterval != 0 && cfg.MaxInterval < cfg.Interval {
+		return errors.New("queue: async: max poll interval < poll interval")
+	}
+	return nil
+}
+
+func (q *async) poll(cfg PollConfig) {
+	defer q.wg.Done()
+	changer, _ := q.q.(Changer)
+	interval := cfg.Interval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	last := atomic.LoadUint64(&q.stats.dequeued)
+	for {
+		select {
+		case <-timer.C:
+		case <-q.quit:
+			return
+		}
+		var active bool
+		if changer != nil {
+			changed, err := changer.Changed()
+			if err != nil {
+				q.report(err)
+			}
+			active = changed
+			if changed || err != nil {
+				q.wake()
+			}
+		} else {
+			// Whether the last poll found data is only known once a
+			// worker has tried to dequeue it.
+			dequeued := atomic.LoadUint64(&q.stats.dequeued)
+			active = dequeued != last
+			last = dequeued
+			q.wake()
+		}
+		switch {
+		case active:
+			interval = cfg.Interval
+		case interval < cfg.MaxInterval:
+			interval *= 2
+			if interval > cfg.MaxInterval {
+				interval = cfg.MaxInterval
+			}
+		}
+		timer.Reset(interval)
+	}
+}
@@ -5,11 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/url"
 	"sync"
+	"sync/atomic"
 
-	// SQLite3 driver.
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/esote/queue/internal/sqlitedb"
 )
 
 // Queue contains data.
@@ -25,32 +24,45 @@ type Queue interface {
 	io.Closer
 }
 
+// Lener is implemented by queues which can report how much data they contain.
+type Lener interface {
+	// Number of items in the queue. Safe for concurrent use.
+	Len() (int, error)
+}
+
+// Changer is implemented by queues which can detect data added by other
+// processes or connections.
+type Changer interface {
+	// Changed reports whether data may have been added since the last
+	// call. Safe for concurrent use.
+	Changed() (bool, error)
+}
+
 // ErrEmpty is returned when dequeuing from an empty queue.
 var ErrEmpty = errors.New("queue: queue is empty")
 
 type sqlite3Queue struct {
 	db *sql.DB
 	st map[string]*sql.Stmt
+
+	// Changes by this queue are counted, since they do not change the
+	// data_version of its connection.
+	enqueues uint64
+	mu       sync.Mutex
+	seen     uint64
+	version  int64
+	checked  bool
 }
 
-// NewSqlite3Queue creates an SQLite3-backed queue with ACID properties.
+// NewSqlite3Queue creates an SQLite3-backed queue with ACID properties. The
+// SQLite3 driver uses cgo, unless built with the purego build tag. Nil data is
+// stored as empty data.
 func NewSqlite3Queue(file string) (Queue, error) {
-	u := &url.URL{
-		Scheme: "file",
-		Opaque: file,
-	}
-	query := u.Query()
-	query.Set("_secure_delete", "on")
-	u.RawQuery = query.Encode()
-
-	db, err := sql.Open("sqlite3", u.String())
+	db, err := sqlitedb.Open(file, true)
 	if err != nil {
 		return nil, err
 	}
 
-	// SQLite3 driver doesn't handle concurrency very well.
-	db.SetMaxOpenConns(1)
-
 	const qCreate = `
 CREATE TABLE IF NOT EXISTS queue (
 	id INTEGER PRIMARY KEY,
@@ -74,7 +86,14 @@ CREATE TABLE IF NOT EXISTS queue (
 }
 
 func (q *sqlite3Queue) Enqueue(data []byte) error {
+	if data == nil {
+		// Nil would be stored as NULL.
+		data = []byte{}
+	}
 	_, err := q.st["enqueue"].Exec(data)
+	if err == nil {
+		atomic.AddUint64(&q.enqueues, 1)
+	}
 	return err
 }
 
@@ -98,6 +117,27 @@ func (q *sqlite3Queue) Dequeue() ([]byte, error) {
 	return data, nil
 }
 
+func (q *sqlite3Queue) Len() (int, error) {
+	var n int
+	err := q.st["len"].QueryRow().Scan(&n)
+	return n, err
+}
+
+func (q *sqlite3Queue) Changed() (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var version int64
+	if err := q.st["version"].QueryRow().Scan(&version); err != nil {
+		return false, err
+	}
+	enqueues := atomic.LoadUint64(&q.enqueues)
+	changed := !q.checked || version != q.version || enqueues != q.seen
+	q.checked = true
+	q.version = version
+	q.seen = enqueues
+	return changed, nil
+}
+
 func (q *sqlite3Queue) Close() error {
 	var err error
 	for _, stmt := range q.st {
@@ -136,6 +176,21 @@ LIMIT 1`)
 	q.st["delete"], err = q.db.Prepare(`
 DELETE FROM queue
 WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+
+	// Count data.
+	q.st["len"], err = q.db.Prepare(`
+SELECT COUNT(*)
+FROM queue`)
+	if err != nil {
+		return err
+	}
+
+	// Detect commits by other connections. There is only one connection,
+	// so the version is always read from the same one.
+	q.st["version"], err = q.db.Prepare(`PRAGMA data_version`)
 	return err
 }
 
@@ -189,6 +244,12 @@ func (q *memoryQueue) Dequeue() ([]byte, error) {
 	return data, nil
 }
 
+func (q *memoryQueue) Len() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.datas), nil
+}
+
 func (q *memoryQueue) Close() error {
 	return nil
 }
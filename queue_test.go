@@ -10,6 +10,7 @@ import (
 
 	"github.com/esote/queue"
 	"github.com/esote/queue/internal/tmpdb"
+	"github.com/esote/queue/pkg/queuetest"
 )
 
 func TestMain(m *testing.M) {
@@ -31,6 +32,13 @@ func newQueues() (map[string]queue.Queue, error) {
 	if err != nil {
 		return nil, err
 	}
+	if file, err = tmpdb.New(); err != nil {
+		return nil, err
+	}
+	queues["bolt"], err = queue.NewBoltQueue(file)
+	if err != nil {
+		return nil, err
+	}
 	return queues, nil
 }
 
@@ -53,6 +61,13 @@ func testQueue(q queue.Queue) error {
 			return err
 		}
 	}
+	if l, ok := q.(queue.Lener); ok {
+		if have, err := l.Len(); err != nil {
+			return err
+		} else if have != int(n) {
+			return fmt.Errorf("want len %d, have %d", n, have)
+		}
+	}
 	for i := byte(0); i < n; i++ {
 		data, err := q.Dequeue()
 		if err != nil {
@@ -119,3 +134,136 @@ func testRace(q queue.Queue) {
 	}
 	wg.Wait()
 }
+
+func TestQueueDurable(t *testing.T) {
+	opens := map[string]func(string) (queue.Queue, error){
+		"sqlite3": queue.NewSqlite3Queue,
+		"bolt":    queue.NewBoltQueue,
+	}
+	for name, open := range opens {
+		if err := testDurable(open); err != nil {
+			t.Fatalf("queue: %s: %s", name, err)
+		}
+	}
+}
+
+func testDurable(open func(string) (queue.Queue, error)) error {
+	file, err := tmpdb.New()
+	if err != nil {
+		return err
+	}
+	q, err := open(file)
+	if err != nil {
+		return err
+	}
+	if err = q.Enqueue([]byte("durable")); err != nil {
+		return err
+	}
+	if err = q.Close(); err != nil {
+		return err
+	}
+	if q, err = open(file); err != nil {
+		return err
+	}
+	defer q.Close()
+	data, err := q.Dequeue()
+	if err != nil {
+		return err
+	}
+	if string(data) != "durable" {
+		return fmt.Errorf("want durable, have %s", data)
+	}
+	return nil
+}
+
+func TestQueueConformance(t *testing.T) {
+	factories := map[string]queuetest.Factory{
+		"memory": func() (queue.Queue, error) {
+			return queue.NewMemoryQueue(), nil
+		},
+		"sqlite3": func() (queue.Queue, error) {
+			file, err := tmpdb.New()
+			if err != nil {
+				return nil, err
+			}
+			return queue.NewSqlite3Queue(file)
+		},
+		"bolt": func() (queue.Queue, error) {
+			file, err := tmpdb.New()
+			if err != nil {
+				return nil, err
+			}
+			return queue.NewBoltQueue(file)
+		},
+	}
+	for name, f := range factories {
+		t.Run(name, func(t *testing.T) {
+			queuetest.Run(t, f)
+		})
+	}
+}
+
+// The SQLite3 queue stores nil data as empty data, rather than failing to store
+// it as NULL.
+func TestQueueSqlite3Nil(t *testing.T) {
+	file, err := tmpdb.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := queue.NewSqlite3Queue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.Enqueue(nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := q.Dequeue()
+	if err != nil || len(data) != 0 {
+		t.Fatalf("want empty data, have %#v (%v)", data, err)
+	}
+}
+
+// The SQLite3 queue detects data added through other connections.
+func TestQueueChanged(t *testing.T) {
+	file, err := tmpdb.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q1, err := queue.NewSqlite3Queue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q1.Close()
+	q2, err := queue.NewSqlite3Queue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q2.Close()
+	c := q1.(queue.Changer)
+	steps := []struct {
+		enqueue queue.Queue
+		want    bool
+	}{
+		{nil, true}, // unknown before the first call
+		{nil, false},
+		{q2, true},
+		{nil, false},
+		{q1, true},
+		{nil, false},
+	}
+	for i, step := range steps {
+		if step.enqueue != nil {
+			if err = step.enqueue.Enqueue([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		changed, err := c.Changed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != step.want {
+			t.Fatalf("step %d: want changed %t", i, step.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+// Token bucket shared by the workers of an async queue.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	change chan struct{}
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	l := &limiter{
+		change: make(chan struct{}),
+	}
+	l.set(rate, burst)
+	return l
+}
+
+// Set the rate in tokens per second and the bucket size. A rate <= 0 disables
+// limiting.
+func (l *limiter) set(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.last.IsZero() || l.rate <= 0 {
+		// Start with a full bucket.
+		l.tokens = float64(burst)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+	}
+	l.rate = rate
+	l.burst = float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// Wake waiters so they observe the new rate.
+	close(l.change)
+	l.change = make(chan struct{})
+}
+
+// Take a token, or return how long until one is available and a channel closed
+// when the rate changes.
+func (l *limiter) take() (time.Duration, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, nil
+	}
+	d := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if d <= 0 {
+		d = 1
+	}
+	return d, l.change
+}
+
+// Give back an unused token.
+func (l *limiter) refund() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate > 0 && l.tokens+1 <= l.burst {
+		l.tokens++
+	}
+}
+
+// Wait for a token. Returns false if quit is received from first.
+func (l *limiter) wait(quit <-chan struct{}) bool {
+	for {
+		d, change := l.take()
+		if d == 0 {
+			return true
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-change:
+			timer.Stop()
+		case <-quit:
+			timer.Stop()
+			return false
+		}
+	}
+}
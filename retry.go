@@ -0,0 +1,188 @@
+package queue
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryHandler operates on data from the async queue. Attempt counts how many
+// times the data has been handled, starting at one. Data for which the handler
+// returns an error is retried according to the queue's RetryConfig.
+type RetryHandler func(data []byte, attempt int) error
+
+// RetryConfig is used to configure retries of data which failed to be handled.
+// The delay before retry n is Backoff * 2^(n-1), at most MaxBackoff, varied
+// randomly by up to Jitter times itself.
+type RetryConfig struct {
+	// Maximum number of times data is handled, including the first.
+	MaxAttempts int
+
+	// Delay before the first retry.
+	Backoff time.Duration
+
+	// Maximum delay between retries. Zero means no maximum.
+	MaxBackoff time.Duration
+
+	// Fraction of the delay, between 0 and 1, by which it is varied.
+	Jitter float64
+
+	// Add failed data back to the inner queue at once, along with its
+	// attempt count, instead of keeping it in memory until it is due. Data
+	// being retried then survives a crash when the inner queue is durable,
+	// but Backoff, MaxBackoff and Jitter are ignored: data is retried once
+	// the data ahead of it in the inner queue has been handled. Other
+	// readers of the inner queue see the attempt count prefixed to the
+	// data.
+	Durable bool
+}
+
+// DefaultRetryConfig is used by NewRetryQueue when no RetryConfig is given.
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts: 5,
+	Backoff:     100 * time.Millisecond,
+	MaxBackoff:  10 * time.Second,
+	Jitter:      0.2,
+}
+
+// RetryError is reported when data is given up on.
+type RetryError struct {
+	Data     []byte
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("queue: async: gave up after %d attempts: %s",
+		e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Prefix of data added back to the inner queue by durable retries, followed by
+// the attempt count as a uvarint and the data.
+var retryPrefix = []byte("\x00queue:retry\x00")
+
+func encodeRetry(data []byte, attempt int) []byte {
+	var n [binary.MaxVarintLen64]byte
+	buf := make([]byte, 0, len(retryPrefix)+len(n)+len(data))
+	buf = append(buf, retryPrefix...)
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(attempt))]...)
+	return append(buf, data...)
+}
+
+// Decode data added back by a durable retry, returning the attempt count.
+// Other data has no attempts.
+func decodeRetry(data []byte) ([]byte, int) {
+	if !bytes.HasPrefix(data, retryPrefix) {
+		return data, 0
+	}
+	attempt, n := binary.Uvarint(data[len(retryPrefix):])
+	if n <= 0 {
+		return data, 0
+	}
+	return data[len(retryPrefix)+n:], int(attempt)
+}
+
+// Data being handled.
+type item struct {
+	data    []byte
+	attempt int
+	due     time.Time
+}
+
+// Failed items waiting to be retried, ordered by due time.
+type retries struct {
+	mu      sync.Mutex
+	items   itemHeap
+	rand    *rand.Rand
+	drained bool
+}
+
+func newRetries() *retries {
+	return &retries{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Schedule the next attempt of it, reporting false if retries were drained.
+func (r *retries) push(it *item, cfg *RetryConfig) bool {
+	d := cfg.Backoff
+	for i := 1; i < it.attempt; i++ {
+		d *= 2
+		if cfg.MaxBackoff > 0 && d >= cfg.MaxBackoff {
+			break
+		}
+	}
+	if cfg.MaxBackoff > 0 && d > cfg.MaxBackoff {
+		d = cfg.MaxBackoff
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.drained {
+		return false
+	}
+	if cfg.Jitter > 0 {
+		d += time.Duration(float64(d) * cfg.Jitter * (2*r.rand.Float64() - 1))
+	}
+	it.due = time.Now().Add(d)
+	heap.Push(&r.items, it)
+	return true
+}
+
+// Pop an item which is due.
+func (r *retries) pop() *item {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.items) == 0 || r.items[0].due.After(time.Now()) {
+		return nil
+	}
+	return heap.Pop(&r.items).(*item)
+}
+
+// Return a timer firing when the next item is due, or nil if there are none.
+func (r *retries) timer() *time.Timer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.items) == 0 {
+		return nil
+	}
+	return time.NewTimer(time.Until(r.items[0].due))
+}
+
+func (r *retries) empty() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.items) == 0
+}
+
+// Remove all items. Later pushes fail.
+func (r *retries) drain() []*item {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drained = true
+	items := r.items
+	r.items = nil
+	return items
+}
+
+type itemHeap []*item
+
+func (h itemHeap) Len() int            { return len(h) }
+func (h itemHeap) Less(i, j int) bool  { return h[i].due.Before(h[j].due) }
+func (h itemHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *itemHeap) Push(x interface{}) { *h = append(*h, x.(*item)) }
+
+func (h *itemHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,138 @@
+package queue
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ScaleConfig is used to configure automatic scaling of the number of workers.
+// Every interval, workers are added when the backlog would take longer than
+// the interval to handle at the recent handler latency, and one worker is
+// removed when the workers have been mostly idle.
+type ScaleConfig struct {
+	// Bounds on the number of workers.
+	MinWorkers int
+	MaxWorkers int
+
+	// How often the number of workers is reconsidered. Zero means one
+	// second.
+	Interval time.Duration
+}
+
+func (cfg *ScaleConfig) check(workers int) error {
+	if cfg.MinWorkers <= 0 {
+		return errors.New("queue: async: min workers <= 0")
+	}
+	if cfg.MaxWorkers < cfg.MinWorkers {
+		return errors.New("queue: async: max workers < min workers")
+	}
+	if workers < cfg.MinWorkers || workers > cfg.MaxWorkers {
+		return errors.New("queue: async: workers out of scaling bounds")
+	}
+	return nil
+}
+
+// Utilization above which the workers are considered saturated when the
+// backlog is unknown, and below which they are considered idle.
+const (
+	scaleBusy = 0.9
+	scaleIdle = 0.5
+)
+
+// Measurements taken by workers.
+type workerStats struct {
+	dequeued  uint64 // number of items dequeued from the inner queue
+	succeeded uint64
+	failed    uint64
+	timedOut  uint64
+	panicked  uint64
+
+	busy  int64 // nanoseconds spent in the handler
+	count int64 // number of items handled
+	empty int32 // whether the inner queue was last found empty
+}
+
+func (s *workerStats) handled(d time.Duration) {
+	atomic.AddInt64(&s.busy, int64(d))
+	atomic.AddInt64(&s.count, 1)
+}
+
+func (s *workerStats) setEmpty(empty bool) {
+	var v int32
+	if empty {
+		v = 1
+	}
+	atomic.StoreInt32(&s.empty, v)
+}
+
+func (s *workerStats) reset() (busy time.Duration, count int64, empty bool) {
+	busy = time.Duration(atomic.SwapInt64(&s.busy, 0))
+	count = atomic.SwapInt64(&s.count, 0)
+	empty = atomic.LoadInt32(&s.empty) == 1
+	return
+}
+
+func (q *async) autoscale(cfg ScaleConfig) {
+	defer q.wg.Done()
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.quit:
+			return
+		}
+		busy, count, empty := q.stats.reset()
+		q.mu.Lock()
+		// Paused workers are neither busy nor idle.
+		if atomic.LoadInt32(&q.state) == open && q.resume == nil {
+			q.resize(scale(&cfg, len(q.stops), q.backlog(), busy,
+				count, empty))
+		}
+		q.mu.Unlock()
+	}
+}
+
+// Length of the inner queue, or -1 if it is unknown.
+func (q *async) backlog() int {
+	if l, ok := q.q.(Lener); ok {
+		if n, err := l.Len(); err == nil {
+			return n
+		}
+	}
+	return -1
+}
+
+// Decide the number of workers given measurements over the last interval.
+func scale(cfg *ScaleConfig, workers, backlog int, busy time.Duration,
+	count int64, empty bool) int {
+	utilization := float64(busy) / float64(time.Duration(workers)*cfg.Interval)
+	var grow bool
+	switch {
+	case backlog < 0:
+		grow = !empty && utilization >= scaleBusy
+	case count == 0:
+		// No handler finished within the interval.
+		grow = backlog > 0 && !empty
+	default:
+		latency := busy / time.Duration(count)
+		grow = time.Duration(backlog)*latency/time.Duration(workers) > cfg.Interval
+	}
+	switch {
+	case grow:
+		workers *= 2
+	case empty && utilization < scaleIdle:
+		workers--
+	}
+	if workers > cfg.MaxWorkers {
+		workers = cfg.MaxWorkers
+	}
+	if workers < cfg.MinWorkers {
+		workers = cfg.MinWorkers
+	}
+	return workers
+}
@@ -0,0 +1,179 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Codec converts values to and from queue data.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Built-in codecs. BytesCodec stores []byte values as-is.
+var (
+	GobCodec   Codec = gobCodec{}
+	JSONCodec  Codec = jsonCodec{}
+	BytesCodec Codec = bytesCodec{}
+)
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type bytesCodec struct{}
+
+func (bytesCodec) Marshal(v interface{}) ([]byte, error) {
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("queue: bytes codec cannot marshal %T", v)
+	}
+	return data, nil
+}
+
+func (bytesCodec) Unmarshal(data []byte, v interface{}) error {
+	p, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("queue: bytes codec cannot unmarshal into %T", v)
+	}
+	*p = data
+	return nil
+}
+
+// DecodeError is returned when queue data cannot be decoded by a codec, to
+// distinguish it from errors of the inner queue.
+type DecodeError struct {
+	Data []byte
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return "queue: decode: " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// TypedQueue contains values of type T, stored in an inner queue.
+type TypedQueue[T any] struct {
+	q     Queue
+	codec Codec
+}
+
+// NewTypedQueue creates a queue storing values in q, encoded by codec. A nil
+// codec means GobCodec. Closing the typed queue closes the inner queue.
+func NewTypedQueue[T any](q Queue, codec Codec) *TypedQueue[T] {
+	if codec == nil {
+		codec = GobCodec
+	}
+	return &TypedQueue[T]{
+		q:     q,
+		codec: codec,
+	}
+}
+
+// Enqueue adds v to the queue. Safe for concurrent use.
+func (q *TypedQueue[T]) Enqueue(v T) error {
+	data, err := q.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return q.q.Enqueue(data)
+}
+
+// Dequeue removes a value from the queue. Safe for concurrent use. Returns
+// ErrEmpty if the queue contains no data, or a *DecodeError if the data cannot
+// be decoded.
+func (q *TypedQueue[T]) Dequeue() (T, error) {
+	var v T
+	data, err := q.q.Dequeue()
+	if err != nil {
+		return v, err
+	}
+	if err = q.codec.Unmarshal(data, &v); err != nil {
+		return v, &DecodeError{Data: data, Err: err}
+	}
+	return v, nil
+}
+
+// Close the queue.
+func (q *TypedQueue[T]) Close() error {
+	return q.q.Close()
+}
+
+// TypedHandler operates on values from the typed async queue. Err comes from
+// the inner queue's dequeue operation when err is not ErrEmpty, or is a
+// *DecodeError when the data cannot be decoded.
+type TypedHandler[T any] func(v T, err error)
+
+// TypedAsyncQueue processes values of type T asynchronously. The methods of
+// the embedded AsyncQueue other than Enqueue may be used as usual.
+type TypedAsyncQueue[T any] struct {
+	AsyncQueue
+	codec Codec
+}
+
+// NewTypedAsyncQueue creates an async queue that processes values stored in q,
+// encoded by codec, through a handler. A nil codec means GobCodec. The async
+// queue is configured by cfg as in NewAsyncQueueConfig. Closing the typed
+// async queue does NOT close the inner queue.
+func NewTypedAsyncQueue[T any](q Queue, codec Codec, handler TypedHandler[T],
+	cfg *AsyncConfig) (*TypedAsyncQueue[T], error) {
+	if codec == nil {
+		codec = GobCodec
+	}
+	if handler == nil {
+		return nil, errors.New("queue: typed: handler is nil")
+	}
+	h := func(data []byte, err error) {
+		var v T
+		if err == nil {
+			if err = codec.Unmarshal(data, &v); err != nil {
+				err = &DecodeError{Data: data, Err: err}
+			}
+		}
+		handler(v, err)
+	}
+	aq, err := NewAsyncQueueConfig(q, h, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedAsyncQueue[T]{
+		AsyncQueue: aq,
+		codec:      codec,
+	}, nil
+}
+
+// Enqueue adds v to the queue. Safe for concurrent use.
+func (q *TypedAsyncQueue[T]) Enqueue(v T) error {
+	data, err := q.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return q.AsyncQueue.Enqueue(data)
+}
@@ -0,0 +1,118 @@
+package queue_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/esote/queue"
+)
+
+type point struct {
+	X, Y int
+}
+
+func TestTyped(t *testing.T) {
+	codecs := map[string]queue.Codec{
+		"gob":  queue.GobCodec,
+		"json": queue.JSONCodec,
+	}
+	for name, codec := range codecs {
+		q := queue.NewTypedQueue[point](queue.NewMemoryQueue(), codec)
+		want := point{1, 2}
+		if err := q.Enqueue(want); err != nil {
+			t.Fatalf("codec: %s: %s", name, err)
+		}
+		have, err := q.Dequeue()
+		if err != nil {
+			t.Fatalf("codec: %s: %s", name, err)
+		}
+		if have != want {
+			t.Fatalf("codec: %s: want %v, have %v", name, want, have)
+		}
+		if _, err = q.Dequeue(); err != queue.ErrEmpty {
+			t.Fatalf("codec: %s: doesn't return ErrEmpty when empty",
+				name)
+		}
+		if err = q.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTypedBytes(t *testing.T) {
+	q := queue.NewTypedQueue[[]byte](queue.NewMemoryQueue(), queue.BytesCodec)
+	want := []byte("raw")
+	if err := q.Enqueue(want); err != nil {
+		t.Fatal(err)
+	}
+	have, err := q.Dequeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("want %s, have %s", want, have)
+	}
+	if err = queue.NewTypedQueue[int](queue.NewMemoryQueue(),
+		queue.BytesCodec).Enqueue(1); err == nil {
+		t.Fatal("bytes codec marshaled int")
+	}
+}
+
+func TestTypedDecodeError(t *testing.T) {
+	inner := queue.NewMemoryQueue()
+	if err := inner.Enqueue([]byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	q := queue.NewTypedQueue[point](inner, queue.JSONCodec)
+	_, err := q.Dequeue()
+	var derr *queue.DecodeError
+	if !errors.As(err, &derr) {
+		t.Fatalf("want DecodeError, have %v", err)
+	}
+	if string(derr.Data) != "not json" {
+		t.Fatalf("unexpected data %s", derr.Data)
+	}
+}
+
+func TestTypedAsync(t *testing.T) {
+	type result struct {
+		p   point
+		err error
+	}
+	results := make(chan result, 2)
+	handler := func(p point, err error) {
+		results <- result{p, err}
+	}
+	inner := queue.NewMemoryQueue()
+	q, err := queue.NewTypedAsyncQueue[point](inner, queue.JSONCodec,
+		handler, &queue.AsyncConfig{Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.Enqueue(point{3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	// Data enqueued directly in the inner queue bypasses the codec.
+	if err = inner.Enqueue([]byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			var derr *queue.DecodeError
+			switch {
+			case r.err == nil && r.p == point{3, 4}:
+			case errors.As(r.err, &derr):
+			default:
+				t.Fatalf("unexpected result %v", r)
+			}
+		case <-timer.C:
+			t.Fatal("value not handled")
+		}
+	}
+}
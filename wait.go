@@ -0,0 +1,76 @@
+package queue
+
+import "sync"
+
+// Tracks whether the async queue is idle: no worker is dequeuing or handling
+// data, and the inner queue has been found empty since the last Enqueue.
+type idleState struct {
+	mu       sync.Mutex
+	active   int    // workers dequeuing or handling data
+	handling int    // workers handling data
+	enqueued uint64 // completed Enqueues
+	emptyAt  uint64 // enqueued when the inner queue was last found empty
+	empty    bool   // whether the inner queue was ever found empty
+	changed  chan struct{}
+}
+
+func newIdleState() *idleState {
+	return &idleState{
+		changed: make(chan struct{}),
+	}
+}
+
+// Count a completed Enqueue.
+func (s *idleState) enqueue() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enqueued++
+}
+
+// Start trying to dequeue, returning the number of completed Enqueues.
+func (s *idleState) begin() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active++
+	return s.enqueued
+}
+
+// Start handling data.
+func (s *idleState) handle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handling++
+}
+
+// Finish a dequeue attempt begun when gen Enqueues were completed, which found
+// the inner queue empty, or handled data.
+func (s *idleState) end(gen uint64, empty, handled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if handled {
+		s.handling--
+	}
+	if empty && (!s.empty || gen > s.emptyAt) {
+		s.empty = true
+		s.emptyAt = gen
+	}
+	if s.active == 0 {
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+}
+
+// Report whether the queue is idle, and a channel closed when that may have
+// changed.
+func (s *idleState) idle() (bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active == 0 && s.empty && s.emptyAt == s.enqueued, s.changed
+}
+
+func (s *idleState) inFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handling
+}